@@ -0,0 +1,285 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The result of validating the ARC chain of an incoming email (RFC 8617)
+type ARCResult string
+
+const (
+	ARCNone ARCResult = "none" // The email carries no ARC sets
+	ARCPass ARCResult = "pass" // Every seal and the latest message signature verified
+	ARCFail ARCResult = "fail" // The chain is malformed or a signature did not verify
+)
+
+// The outcome of validating the ARC chain of an incoming email, which records
+// the authentication results seen by each intermediary that forwarded it
+type ARCCheck struct {
+	Result    ARCResult // Result of the validation
+	Instances int       // Number of ARC sets on the email
+	Reason    string    // Why the chain failed to validate
+}
+
+// Maximum number of ARC sets allowed on an email (RFC 8617 Section 4.2.1)
+const arcMaxInstances = 50
+
+// A header field exactly as it appeared in a message
+type headerField struct {
+	name string // Field name as written
+	raw  string // Complete field including the name and trailing CRLF
+}
+
+// Returns the unfolded value of the field
+func (f headerField) value() string {
+	_, value, _ := strings.Cut(f.raw, ":")
+	return strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "").Replace(value))
+}
+
+// Split a message into its header fields and body, line endings are normalized to CRLF
+func splitMessage(message []byte) ([]headerField, []byte) {
+	message = bytes.ReplaceAll(message, []byte("\r\n"), []byte("\n"))
+	message = bytes.ReplaceAll(message, []byte("\n"), []byte("\r\n"))
+	header, body, ok := bytes.Cut(message, []byte("\r\n\r\n"))
+	if !ok {
+		header, body = message, nil
+	}
+	if bytes.HasPrefix(message, []byte("\r\n")) {
+		header, body = nil, message[2:]
+	}
+
+	var fields []headerField
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		switch {
+		case line == "":
+		case (line[0] == ' ' || line[0] == '\t') && len(fields) > 0:
+			fields[len(fields)-1].raw += line
+		default:
+			name, _, _ := strings.Cut(line, ":")
+			fields = append(fields, headerField{name: strings.TrimSpace(name), raw: line})
+		}
+	}
+	if n := len(fields); n > 0 && !strings.HasSuffix(fields[n-1].raw, "\r\n") {
+		fields[n-1].raw += "\r\n"
+	}
+	return fields, body
+}
+
+// Parse a tag list such as "a=rsa-sha256; d=example.org", whitespace within values is removed
+func parseTagList(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		name, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(value), "")
+	}
+	return tags
+}
+
+var (
+	canonicalSpaces  = regexp.MustCompile(`[ \t]+`)
+	signatureBodyTag = regexp.MustCompile(`([;:][ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+)
+
+// Canonicalize a header field (RFC 6376 Section 3.4.1 and 3.4.2)
+func canonicalizeHeader(raw string, relaxed bool) string {
+	if !relaxed {
+		return raw
+	}
+	name, value, _ := strings.Cut(raw, ":")
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	value = strings.TrimSpace(canonicalSpaces.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+// Canonicalize a message body (RFC 6376 Section 3.4.3 and 3.4.4)
+func canonicalizeBody(body []byte, relaxed bool) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	if relaxed {
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(canonicalSpaces.ReplaceAllString(line, " "), " ")
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if relaxed {
+			return nil
+		}
+		return []byte("\r\n")
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// Validate the ARC chain of an incoming email (RFC 8617 Section 5.2)
+func (e *Engine) checkARC(ctx context.Context, message []byte) *ARCCheck {
+	fields, body := splitMessage(message)
+	fail := func(format string, a ...any) *ARCCheck {
+		return &ARCCheck{Result: ARCFail, Reason: fmt.Sprintf(format, a...)}
+	}
+
+	// Collect ARC Sets
+	type arcSet struct{ results, signature, seal *headerField }
+	sets := map[int]*arcSet{}
+	for i := range fields {
+		f := &fields[i]
+		name := strings.ToLower(f.name)
+		if name != "arc-authentication-results" && name != "arc-message-signature" && name != "arc-seal" {
+			continue
+		}
+		first, _, _ := strings.Cut(f.value(), ";")
+		tag, value, _ := strings.Cut(first, "=")
+		instance, err := strconv.Atoi(strings.TrimSpace(value))
+		if strings.TrimSpace(tag) != "i" || err != nil || instance < 1 || instance > arcMaxInstances {
+			return fail("invalid instance in %s", f.name)
+		}
+		set, ok := sets[instance]
+		if !ok {
+			set = &arcSet{}
+			sets[instance] = set
+		}
+		slot := &set.results
+		switch name {
+		case "arc-message-signature":
+			slot = &set.signature
+		case "arc-seal":
+			slot = &set.seal
+		}
+		if *slot != nil {
+			return fail("duplicate %s for instance %d", f.name, instance)
+		}
+		*slot = f
+	}
+	if len(sets) == 0 {
+		return &ARCCheck{Result: ARCNone}
+	}
+
+	// Check Chain Structure
+	latest := len(sets)
+	for i := 1; i <= latest; i++ {
+		set, ok := sets[i]
+		if !ok || set.results == nil || set.signature == nil || set.seal == nil {
+			return fail("incomplete arc set for instance %d", i)
+		}
+		cv := parseTagList(set.seal.value())["cv"]
+		switch {
+		case i == latest && cv == "fail":
+			return fail("chain was marked as failed by instance %d", i)
+		case i == 1 && cv != "none":
+			return fail("first arc seal has cv=%s", cv)
+		case i > 1 && cv != "pass":
+			return fail("arc seal for instance %d has cv=%s", i, cv)
+		}
+	}
+
+	// Verify Latest Message Signature
+	if err := e.verifyMessageSignature(ctx, fields, body, sets[latest].signature); err != nil {
+		return fail("arc message signature %d: %s", latest, err)
+	}
+
+	// Verify Seals
+	// 	Each seal covers every ARC set up to and including its own
+	for i := latest; i >= 1; i-- {
+		var sealed strings.Builder
+		for j := 1; j <= i; j++ {
+			sealed.WriteString(canonicalizeHeader(sets[j].results.raw, true))
+			sealed.WriteString(canonicalizeHeader(sets[j].signature.raw, true))
+			if j < i {
+				sealed.WriteString(canonicalizeHeader(sets[j].seal.raw, true))
+			}
+		}
+		seal := sets[i].seal
+		sealed.WriteString(strings.TrimSuffix(canonicalizeHeader(signatureBodyTag.ReplaceAllString(seal.raw, "$1"), true), "\r\n"))
+		if err := e.verifySignature(ctx, parseTagList(seal.value()), sealed.String()); err != nil {
+			return fail("arc seal %d: %s", i, err)
+		}
+	}
+	return &ARCCheck{Result: ARCPass, Instances: latest}
+}
+
+// Verify a signature covering the body and header fields of a message, an ARC
+// Message Signature is a DKIM signature with an instance in place of a version
+func (e *Engine) verifyMessageSignature(ctx context.Context, fields []headerField, body []byte, signature *headerField) error {
+	tags := parseTagList(signature.value())
+	headerCanon, bodyCanon, _ := strings.Cut(tags["c"], "/")
+	canonical := canonicalizeBody(body, bodyCanon == "relaxed")
+	if l, ok := tags["l"]; ok {
+		if n, err := strconv.Atoi(l); err == nil && n < len(canonical) {
+			canonical = canonical[:n]
+		}
+	}
+	bodyHash := sha256.Sum256(canonical)
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return fmt.Errorf("body hash does not match")
+	}
+
+	// Signed header fields are taken from the bottom up
+	var signed strings.Builder
+	used := make(map[int]bool)
+	for _, key := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, key) {
+				used[i] = true
+				signed.WriteString(canonicalizeHeader(fields[i].raw, headerCanon == "relaxed"))
+				break
+			}
+		}
+	}
+	signed.WriteString(strings.TrimSuffix(canonicalizeHeader(signatureBodyTag.ReplaceAllString(signature.raw, "$1"), headerCanon == "relaxed"), "\r\n"))
+	return e.verifySignature(ctx, tags, signed.String())
+}
+
+// Verify a signature over some canonicalized data using the public key
+// published by the signer at {s}._domainkey.{d}
+func (e *Engine) verifySignature(ctx context.Context, tags map[string]string, data string) error {
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fmt.Errorf("malformed signature")
+	}
+	txts, err := e.Resolver.LookupTXT(ctx, tags["s"]+"._domainkey."+tags["d"])
+	if err != nil || len(txts) == 0 {
+		return fmt.Errorf("cannot lookup public key: %v", err)
+	}
+	record := parseTagList(strings.Join(txts, ""))
+	public, err := base64.StdEncoding.DecodeString(record["p"])
+	if err != nil || len(public) == 0 {
+		return fmt.Errorf("public key is malformed or revoked")
+	}
+
+	hashed := sha256.Sum256([]byte(data))
+	switch tags["a"] {
+	case "rsa-sha256":
+		key, err := x509.ParsePKIXPublicKey(public)
+		if err != nil {
+			key, err = x509.ParsePKCS1PublicKey(public)
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if err != nil || !ok {
+			return fmt.Errorf("public key is not an rsa key")
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hashed[:], signature); err != nil {
+			return fmt.Errorf("signature did not verify")
+		}
+	case "ed25519-sha256":
+		if len(public) != ed25519.PublicKeySize || !ed25519.Verify(public, hashed[:], signature) {
+			return fmt.Errorf("signature did not verify")
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm: %s", tags["a"])
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package email
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalization(t *testing.T) {
+	// RFC 6376 Section 3.4.5
+	message := []byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n")
+	fields, body := splitMessage(message)
+	if len(fields) != 2 {
+		t.Fatalf("got %d header fields, want 2", len(fields))
+	}
+
+	var relaxed, simple strings.Builder
+	for _, f := range fields {
+		relaxed.WriteString(canonicalizeHeader(f.raw, true))
+		simple.WriteString(canonicalizeHeader(f.raw, false))
+	}
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"relaxed header", relaxed.String(), "a:X\r\nb:Y Z\r\n"},
+		{"simple header", simple.String(), "A: X\r\nB : Y\t\r\n\tZ  \r\n"},
+		{"relaxed body", string(canonicalizeBody(body, true)), " C\r\nD E\r\n"},
+		{"simple body", string(canonicalizeBody(body, false)), " C \r\nD \t E\r\n"},
+		{"relaxed empty body", string(canonicalizeBody(nil, true)), ""},
+		{"simple empty body", string(canonicalizeBody(nil, false)), "\r\n"},
+		{"relaxed blank body", string(canonicalizeBody([]byte("\r\n\r\n"), true)), ""},
+		{"simple blank body", string(canonicalizeBody([]byte("\r\n\r\n"), false)), "\r\n"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, test.got, test.want)
+		}
+	}
+
+	// Bare line feeds are treated as CRLF
+	_, body = splitMessage([]byte("A: X\nB: Y\n\nline\n"))
+	if string(body) != "line\r\n" {
+		t.Errorf("bare line feeds: got %q", body)
+	}
+}
+
+// Adds ARC sets to a message as an intermediary would
+type testARCSealer struct {
+	signer    crypto.Signer
+	algorithm string
+	sets      [][3]string // Authentication results, message signature and seal of each instance
+}
+
+func newTestARCSealer(t *testing.T, algorithm string) (*testARCSealer, string) {
+	s := &testARCSealer{algorithm: algorithm}
+	var public []byte
+	switch algorithm {
+	case "ed25519-sha256":
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.signer, public = privateKey, publicKey
+	case "rsa-sha256":
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if public, err = x509.MarshalPKIXPublicKey(&privateKey.PublicKey); err != nil {
+			t.Fatal(err)
+		}
+		s.signer = privateKey
+	}
+	keyType := strings.TrimSuffix(algorithm, "-sha256")
+	return s, fmt.Sprintf("v=DKIM1; k=%s; p=%s", keyType, base64.StdEncoding.EncodeToString(public))
+}
+
+// Sign canonicalized data, returning the value for the b= tag
+func (s *testARCSealer) sign(t *testing.T, data string) string {
+	hashed := sha256.Sum256([]byte(data))
+	var opts crypto.SignerOpts = crypto.SHA256
+	if s.algorithm == "ed25519-sha256" {
+		opts = crypto.Hash(0)
+	}
+	signature, err := s.signer.Sign(rand.Reader, hashed[:], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+// Returns the message with a new ARC set added to the top of its header
+func (s *testARCSealer) seal(t *testing.T, message []byte, cv string) []byte {
+	instance := len(s.sets) + 1
+	fields, body := splitMessage(message)
+
+	results := fmt.Sprintf("ARC-Authentication-Results: i=%d; example.org; spf=pass smtp.mailfrom=example.com\r\n", instance)
+
+	// Message Signature
+	bodyHash := sha256.Sum256(canonicalizeBody(body, true))
+	signature := fmt.Sprintf(
+		"ARC-Message-Signature: i=%d; a=%s; c=relaxed/relaxed; d=example.org; s=arc; h=from:to:subject; bh=%s; b=",
+		instance, s.algorithm, base64.StdEncoding.EncodeToString(bodyHash[:]),
+	)
+	var signed strings.Builder
+	for _, name := range []string{"from", "to", "subject"} {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(fields[i].name, name) {
+				signed.WriteString(canonicalizeHeader(fields[i].raw, true))
+				break
+			}
+		}
+	}
+	signed.WriteString(strings.TrimSuffix(canonicalizeHeader(signature, true), "\r\n"))
+	signature += s.sign(t, signed.String()) + "\r\n"
+
+	// Seal
+	seal := fmt.Sprintf("ARC-Seal: i=%d; a=%s; cv=%s; d=example.org; s=arc; b=", instance, s.algorithm, cv)
+	var sealed strings.Builder
+	for _, set := range s.sets {
+		for _, raw := range set {
+			sealed.WriteString(canonicalizeHeader(raw, true))
+		}
+	}
+	sealed.WriteString(canonicalizeHeader(results, true))
+	sealed.WriteString(canonicalizeHeader(signature, true))
+	sealed.WriteString(strings.TrimSuffix(canonicalizeHeader(seal, true), "\r\n"))
+	seal += s.sign(t, sealed.String()) + "\r\n"
+
+	s.sets = append(s.sets, [3]string{results, signature, seal})
+	return append([]byte(seal+signature+results), message...)
+}
+
+const testARCMessage = "From: Sender <sender@example.com>\r\n" +
+	"To: recipient@example.net\r\n" +
+	"Subject: Hello  there\r\n" +
+	"\r\n" +
+	"Hello World!\r\n"
+
+func TestARC(t *testing.T) {
+	for _, algorithm := range []string{"ed25519-sha256", "rsa-sha256"} {
+		sealer, record := newTestARCSealer(t, algorithm)
+		e := New("mx.example.net")
+		e.Resolver = &testResolver{txt: map[string][]string{"arc._domainkey.example.org": {record}}}
+
+		once := sealer.seal(t, []byte(testARCMessage), "none")
+		twice := sealer.seal(t, once, "pass")
+
+		tests := []struct {
+			name      string
+			message   string
+			result    ARCResult
+			instances int
+		}{
+			{"no arc sets", testARCMessage, ARCNone, 0},
+			{"one set", string(once), ARCPass, 1},
+			{"two sets", string(twice), ARCPass, 2},
+			{"bare line feeds", strings.ReplaceAll(string(twice), "\r\n", "\n"), ARCPass, 2},
+			{"whitespace changed", strings.Replace(string(twice), "Hello  there", "Hello \t there", 1), ARCPass, 2},
+			{"body modified", strings.Replace(string(twice), "Hello World!", "Hello World?", 1), ARCFail, 0},
+			{"signed header modified", strings.Replace(string(twice), "Subject: Hello", "Subject: Goodbye", 1), ARCFail, 0},
+			{"results modified", strings.Replace(string(twice), "i=1; example.org; spf=pass", "i=1; example.org; spf=fail", 1), ARCFail, 0},
+			{"seal whitespace changed", strings.Replace(string(twice), "cv=pass; d=", "cv=pass;\t d=", 1), ARCPass, 2},
+			{"seal modified", strings.Replace(string(twice), "cv=pass; d=", "cv=pass ; d=", 1), ARCFail, 0},
+			{"seal signature modified", corruptSeal(string(twice), 1), ARCFail, 0},
+			{"missing instance", removeField(string(twice), "ARC-Message-Signature: i=1"), ARCFail, 0},
+			{"duplicate instance", sealer.sets[0][0] + string(twice), ARCFail, 0},
+			{"invalid instance", "ARC-Seal: i=0; cv=none\r\n" + string(once), ARCFail, 0},
+			{"first seal not cv=none", string(newTestChain(t, sealer, "pass")), ARCFail, 0},
+			{"later seal not cv=pass", string(newTestChain(t, sealer, "none", "none")), ARCFail, 0},
+			{"chain marked failed", string(newTestChain(t, sealer, "none", "fail")), ARCFail, 0},
+		}
+		for _, test := range tests {
+			check := e.checkARC(context.Background(), []byte(test.message))
+			if check.Result != test.result || check.Instances != test.instances {
+				t.Errorf("%s %s: got %s %d (%s), want %s %d", algorithm, test.name,
+					check.Result, check.Instances, check.Reason, test.result, test.instances,
+				)
+			}
+		}
+
+		// Unknown Key
+		e.Resolver = &testResolver{}
+		if check := e.checkARC(context.Background(), once); check.Result != ARCFail {
+			t.Errorf("%s unknown key: got %s", algorithm, check.Result)
+		}
+	}
+}
+
+// Seal the test message once for each chain validation status
+func newTestChain(t *testing.T, sealer *testARCSealer, cvs ...string) []byte {
+	chain := &testARCSealer{signer: sealer.signer, algorithm: sealer.algorithm}
+	message := []byte(testARCMessage)
+	for _, cv := range cvs {
+		message = chain.seal(t, message, cv)
+	}
+	return message
+}
+
+// Returns the message without the header field starting with the given prefix
+func removeField(message, prefix string) string {
+	fields, body := splitMessage([]byte(message))
+	var b strings.Builder
+	for _, f := range fields {
+		if !strings.HasPrefix(f.raw, prefix) {
+			b.WriteString(f.raw)
+		}
+	}
+	return b.String() + "\r\n" + string(body)
+}
+
+// Returns the message with the signature of the given ARC seal corrupted
+func corruptSeal(message string, instance int) string {
+	fields, body := splitMessage([]byte(message))
+	var b strings.Builder
+	for _, f := range fields {
+		raw := f.raw
+		if strings.HasPrefix(raw, fmt.Sprintf("ARC-Seal: i=%d;", instance)) {
+			i := strings.LastIndex(raw, "b=") + 2
+			flipped := "A"
+			if raw[i] == 'A' {
+				flipped = "B"
+			}
+			raw = raw[:i] + flipped + raw[i+1:]
+		}
+		b.WriteString(raw)
+	}
+	return b.String() + "\r\n" + string(body)
+}
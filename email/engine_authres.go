@@ -0,0 +1,144 @@
+package email
+
+import (
+	"bytes"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// The result of verifying a DKIM signature
+type DKIMResult string
+
+const (
+	DKIMPass      DKIMResult = "pass"      // The signature verified
+	DKIMFail      DKIMResult = "fail"      // The signature did not verify
+	DKIMTempError DKIMResult = "temperror" // The public key could not be retrieved
+	DKIMPermError DKIMResult = "permerror" // The signature or public key is malformed
+)
+
+// The outcome of verifying one DKIM signature on an incoming email
+type DKIMCheck struct {
+	Result     DKIMResult // Result of the verification
+	Domain     string     // Signing Domain (d=)
+	Identifier string     // Agent or User Identifier (i=)
+	Reason     string     // Why the signature failed to verify
+}
+
+// Every authentication check performed on an incoming email, checks which
+// were disabled are left empty
+type AuthResults struct {
+	DKIM  []DKIMCheck // One result per DKIM signature, empty if the email is unsigned
+	SPF   *SPFCheck   // Result of the SPF check
+	DMARC *DMARCCheck // Result of the DMARC evaluation
+	ARC   *ARCCheck   // Result of validating the ARC chain
+}
+
+// Convert the verifications returned by the DKIM package
+func newDKIMChecks(verifications []*dkim.Verification) []DKIMCheck {
+	checks := make([]DKIMCheck, 0, len(verifications))
+	for _, v := range verifications {
+		check := DKIMCheck{Result: DKIMPass, Domain: v.Domain, Identifier: v.Identifier}
+		if v.Err != nil {
+			check.Reason = v.Err.Error()
+			switch {
+			case dkim.IsTempFail(v.Err):
+				check.Result = DKIMTempError
+			case dkim.IsPermFail(v.Err):
+				check.Result = DKIMPermError
+			default:
+				check.Result = DKIMFail
+			}
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// Format the results as the value of an Authentication-Results header (RFC 8601),
+// identifying ourselves with the given authentication service
+func (a *AuthResults) Header(authservID string) string {
+	var results []authres.Result
+	for _, d := range a.DKIM {
+		results = append(results, &authres.DKIMResult{
+			Value:      authres.ResultValue(d.Result),
+			Reason:     d.Reason,
+			Domain:     d.Domain,
+			Identifier: d.Identifier,
+		})
+	}
+	if a.SPF != nil {
+		r := &authres.SPFResult{Value: authres.ResultValue(a.SPF.Result)}
+		if a.SPF.Identity == "helo" {
+			r.Helo = a.SPF.Domain
+		} else {
+			r.From = a.SPF.Domain
+		}
+		results = append(results, r)
+	}
+	if a.DMARC != nil {
+		results = append(results, &authres.DMARCResult{
+			Value: authres.ResultValue(a.DMARC.Result),
+			From:  a.DMARC.Domain,
+		})
+	}
+	if a.ARC != nil {
+		// The ARC result type isn't recognized by Format so we write it ourselves
+		results = append(results, &authres.GenericResult{
+			Method: "arc",
+			Value:  authres.ResultValue(a.ARC.Result),
+			Params: map[string]string{},
+		})
+	}
+	// Format leaves a trailing space after results without properties
+	return strings.TrimSpace(authres.Format(authservID, results))
+}
+
+// Format a header field folded at whitespace, keeping lines within 78
+// characters where possible (RFC 5322 section 2.2.3)
+func foldHeader(name, value string) string {
+	var b strings.Builder
+	b.WriteString(name + ":")
+	line := len(name) + 1
+	for i, word := range strings.Split(value, " ") {
+		if i > 0 && word != "" && line+1+len(word) > 78 {
+			b.WriteString("\r\n")
+			line = 0
+		}
+		b.WriteString(" " + word)
+		line += 1 + len(word)
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+var headerComment = regexp.MustCompile(`\([^()]*\)`)
+
+// Remove any Authentication-Results fields claiming to be from our authentication
+// service (RFC 8601 Section 5), otherwise a sender could forge results in our name
+func stripAuthResults(message []byte, authservID string) []byte {
+	fields, body := splitMessage(message)
+	forged := func(f headerField) bool {
+		if !strings.EqualFold(f.name, "Authentication-Results") {
+			return false
+		}
+		value, _, _ := strings.Cut(headerComment.ReplaceAllString(f.value(), " "), ";")
+		id := strings.Fields(value)
+		return len(id) > 0 && strings.EqualFold(strings.TrimSuffix(id[0], "."), strings.TrimSuffix(authservID, "."))
+	}
+	if !slices.ContainsFunc(fields, forged) {
+		return message
+	}
+	var stripped bytes.Buffer
+	for _, f := range fields {
+		if !forged(f) {
+			stripped.WriteString(f.raw)
+		}
+	}
+	stripped.WriteString("\r\n")
+	stripped.Write(body)
+	return stripped.Bytes()
+}
@@ -4,8 +4,11 @@ import (
 	"context"
 	"crypto"
 	"crypto/tls"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,28 +18,75 @@ import (
 type HandlerAuthorization = func(r *http.Request) bool
 type HandlerMiddleware = func(e *Email) (bool, error)
 type HandlerEmail = func(e *Email) error
+type HandlerRecipient = func(address string) (bool, error)
 type HandlerError = func(e error)
+type HandlerDelivery = func(e *Email, results []DeliveryResult)
+type HandlerDial = func(ctx context.Context, network, addr string) (net.Conn, error)
 
 type Engine struct {
 	activeClosing         sync.Once               // Prevents multiple shutdowns
 	activeWorkers         sync.WaitGroup          // Tracks open email workers
 	OutgoingWorkerCount   int                     // Thread Count for Queue Processing (Defaults to the value of runtime.NumCPUs())
 	OutgoingTimeout       time.Duration           // Outgoing Email Timeout
-	outgoingQueue         chan *Email             // Outgoing Email Queue
+	OutgoingPort          int                     // Port used when connecting to mail exchangers (Defaults to 25)
+	OutgoingDialer        HandlerDial             // Opens connections to mail exchangers (Defaults to a net.Dialer)
+	OutgoingTLSPolicy     TLSPolicy               // Determines how STARTTLS is used for outgoing emails (Defaults to TLSOpportunistic)
+	OutgoingTLSConfig     *tls.Config             // Base TLS Configuration for STARTTLS, the server name is set per connection
+	OutgoingRelay         *Relay                  // Relay all outgoing emails through a smart host instead of their mail exchangers (Defaults to none)
+	OutgoingRelayDomains  map[string]*Relay       // Relay emails for the given recipient domains through a smart host, overriding OutgoingRelay
+	OutgoingTransport     *TransportMap           // Routing Rules by recipient domain, overriding OutgoingRelay and OutgoingRelayDomains (Defaults to none)
+	OutgoingGenerateText  bool                    // Generate a plain text body for emails which only have an HTML body (Defaults to false)
+	OutgoingPoolSize      int                     // Maximum idle SMTP sessions kept open per destination for reuse, 0 disables reuse (Defaults to 2)
+	OutgoingPoolTimeout   time.Duration           // Close idle SMTP sessions after given duration (Defaults to 30 seconds)
+	outgoingPool          *sessionPool            // Idle SMTP Sessions
+	OutgoingRateLimit     RateLimit               // Rate Limit applied to every recipient domain (Defaults to unlimited)
+	OutgoingRateLimits    map[string]RateLimit    // Rate Limits for specific recipient domains (e.g. "gmail.com"), overriding OutgoingRateLimit
+	outgoingLimiter       *rateLimiter            // Rate Limiting State
+	OutgoingRetryInterval time.Duration           // Initial delay before retrying a deferred email, doubled each attempt (Defaults to 1 minute)
+	OutgoingRetryMaximum  time.Duration           // Upper bound on the delay between retries (Defaults to 1 hour)
+	OutgoingMaxQueueAge   time.Duration           // Give up on deferred emails that have been queued longer than given duration (Defaults to 5 days)
+	OutgoingQueueSize     int                     // Reject Outgoing Emails if the queue holds more than given value (Defaults to 1024)
+	OutgoingQueuePath     string                  // Path to the log used by the default Queue Store (Defaults to "outgoing.wal")
+	OutgoingQueueStore    QueueStore              // Persistent Storage for the Outgoing Queue (Defaults to a FileQueue at OutgoingQueuePath)
+	outgoingStoreOnce     sync.Once               // Opens and replays the Queue Store
+	outgoingStoreErr      error                   // Error encountered while opening the Queue Store
+	outgoingQueue         *outgoingQueue          // Outgoing Email Queue
+	OutgoingStatusStore   StatusStore             // Storage for Delivery Statuses of Queued Emails (Defaults to an in-memory store keeping statuses for 7 days)
+	OutgoingBounceNotify  bool                    // Send delivery status notifications for bounced emails (Defaults to true)
+	OutgoingBounceInbox   string                  // Address of a registered inbox which receives notifications instead of the original sender (Defaults to none)
+	OutgoingDelayNotify   []time.Duration         // Send a delayed delivery notification once an email has been queued for each given duration (Defaults to none)
 	outgoingMiddleware    []HandlerMiddleware     // Outgoing Email Middleware
 	outgoingDKIMSigner    crypto.Signer           // Private Key for DKIM Signing
 	OutgoingSelectorName  string                  // DKIM selector used for signing outgoing emails (default: "default")
+	OutgoingDKIMSigners   []DKIMSigner            // Additional DKIM Keys, outgoing emails carry one signature per key
+	OutgoingDKIMHeaders   []string                // Header fields covered by DKIM signatures, must include From (Defaults to all headers)
+	OutgoingDKIMCanonical string                  // DKIM Canonicalization as header/body (Defaults to "simple/simple")
+	OutgoingDKIMExpiry    time.Duration           // Lifetime of DKIM signatures, 0 to never expire (Defaults to 0)
+	OutgoingDKIMKeyring   *DKIMKeyring            // DKIM Keys rotated on a schedule, used alongside the keys above (Defaults to none)
 	IncomingValidateDKIM  bool                    // Validate Incoming Emails with DKIM? (Defaults to true)
+	IncomingValidateSPF   bool                    // Check the SPF policy of Incoming Email senders? (Defaults to true)
+	IncomingSPFActions    map[SPFResult]SPFAction // Action taken for each SPF Result (Defaults to rejecting fail and deferring temperror)
+	IncomingValidateDMARC bool                    // Evaluate the DMARC policy of Incoming Email senders? (Defaults to true)
+	IncomingDMARCReject   bool                    // Reject Incoming Emails when the sender's DMARC policy says to (Defaults to true)
+	IncomingValidateARC   bool                    // Validate the ARC chain of Incoming Emails? (Defaults to true)
 	IncomingMaxRecipients int                     // Reject Incoming Email if amount of recipients is larger than given value (Defaults to 5)
 	IncomingMaxBytes      int64                   // Reject Incoming Email if payload is larger than x bytes (Defaults to 10MB)
 	IncomingTimeout       time.Duration           // Reject Incoming Email if processing takes longer than given duration
 	incomingMiddleware    []HandlerMiddleware     // Incoming Email Middleware
 	Domain                string                  // Advertising Domain for SMTP Server
+	Resolver              Resolver                // DNS Resolver for MX Lookups (Defaults to a CachingResolver wrapping the system resolver, which cannot report TTLs so answers are kept for 5 minutes, wrap a DNSResolver to honor TTLs)
 	ErrorLogger           HandlerError            // Provided Error Handler
-	NoInboxHandler        HandlerEmail            // Provided No Inbox Handler
+	DeliveryHandler       HandlerDelivery         // Provided Handler for per-recipient results after each attempt of a queued email
+	NoInboxHandler        HandlerEmail            // Provided Handler for recipients accepted by RecipientValidator which have no inbox
+	RecipientValidator    HandlerRecipient        // Accepts recipients which have no inbox, such as a catch-all, requires NoInboxHandler (Defaults to none)
 	AuthHandler           HandlerAuthorization    // Determines if a REST API request is authorized
+	Templates             *TemplateRegistry       // Templates available to POST /send-template (Defaults to none)
+	SubmissionUsers       CredentialStore         // Accounts permitted to send through the submission listener (Defaults to none)
+	SubmissionRecipients  int                     // Reject Submitted Emails if amount of recipients is larger than given value (Defaults to 100)
 	inboxes               map[string]HandlerEmail // Incoming Email Inbox Handlers
+	domains               map[string][]DKIMSigner // Additional Hosted Domains and their DKIM Keys
 	smtpServer            *smtp.Server            // Email Server
+	submissionServer      *smtp.Server            // Email Submission Server
 	httpServer            *http.Server            // HTTP Server
 }
 
@@ -59,8 +109,12 @@ func (e *Engine) StartHTTP(addr string, tlsConfig *tls.Config) error {
 
 // Start the internal SMTP Server and Outbound Queue Workers.
 // Provide a nil tlsConfig to disable TLS.
-// Provide a nil dkimSigner to disable the signing of outbound emails.
+// Provide a nil dkimSigner to only sign outbound emails with OutgoingDKIMSigners.
 func (e *Engine) StartSMTP(addr string, dkimSigner crypto.Signer, tlsConfig *tls.Config) error {
+	if e.RecipientValidator != nil && e.NoInboxHandler == nil {
+		// Otherwise recipients accepted at RCPT would be refused after sending their email
+		return fmt.Errorf("smtp server requires a NoInboxHandler when using a RecipientValidator")
+	}
 
 	// Initialize Server
 	smtpServer := smtp.NewServer(&Backend{engine: e})
@@ -73,25 +127,66 @@ func (e *Engine) StartSMTP(addr string, dkimSigner crypto.Signer, tlsConfig *tls
 	smtpServer.TLSConfig = tlsConfig
 	e.outgoingDKIMSigner = dkimSigner
 	e.smtpServer = smtpServer
+	if err := e.validateDKIM(); err != nil {
+		return err
+	}
+
+	// Normalize Rate Limits
+	// 	Recipient domains are looked up in lower case
+	limits := make(map[string]RateLimit, len(e.OutgoingRateLimits))
+	for domain, limit := range e.OutgoingRateLimits {
+		limits[strings.ToLower(domain)] = limit
+	}
+	e.OutgoingRateLimits = limits
+
+	// Replay Unsent Emails
+	store, err := e.openQueueStore()
+	if err != nil {
+		return err
+	}
 
 	// Start Worker Threads
 	for i := 0; i < e.OutgoingWorkerCount; i++ {
 		e.activeWorkers.Add(1)
-		go func() {
-			defer e.activeWorkers.Done()
-			for email := range e.outgoingQueue {
-				if err := e.SendEmail(email); err != nil {
-					e.ErrorLogger(err)
-				}
-			}
-		}()
+		go e.outgoingWorker(store)
 	}
 
 	return smtpServer.ListenAndServe()
 }
 
+// Start the SMTP Submission Server (RFC 6409) for mail clients and applications.
+// Users authenticate against SubmissionUsers and accepted emails are signed and
+// queued, they are delivered by the workers started with StartSMTP.
+// Use port 587 for STARTTLS or set implicitTLS for port 465, either way a
+// tlsConfig is required as users may only authenticate over TLS.
+func (e *Engine) StartSubmission(addr string, tlsConfig *tls.Config, implicitTLS bool) error {
+	if tlsConfig == nil {
+		return fmt.Errorf("submission server requires a tls config")
+	}
+	if e.SubmissionUsers == nil {
+		return fmt.Errorf("submission server requires a credential store")
+	}
+
+	// Initialize Server
+	submissionServer := smtp.NewServer(&Backend{engine: e, submission: true})
+	submissionServer.Addr = addr
+	submissionServer.Domain = e.Domain
+	submissionServer.ReadTimeout = e.IncomingTimeout
+	submissionServer.WriteTimeout = e.OutgoingTimeout
+	submissionServer.MaxMessageBytes = e.IncomingMaxBytes
+	submissionServer.MaxRecipients = e.SubmissionRecipients
+	submissionServer.TLSConfig = tlsConfig
+	e.submissionServer = submissionServer
+
+	if implicitTLS {
+		return submissionServer.ListenAndServeTLS()
+	}
+	return submissionServer.ListenAndServe()
+}
+
 // Gracefully attempt to shutdown the REST API and SMTP servers if started.
-// It will return once all connections are closed and emails have been sent.
+// It will return once all connections are closed and in-flight emails have been
+// attempted, any emails still waiting in the queue will be sent on next startup.
 // It is safe to call this function multiple times.
 func (e *Engine) Shutdown(ctx context.Context) {
 	e.activeClosing.Do(func() {
@@ -106,6 +201,16 @@ func (e *Engine) Shutdown(ctx context.Context) {
 				}
 			}()
 		}
+		if e.submissionServer != nil {
+			wg.Add(1)
+			go func() {
+				// Wait for Submission Connections to Finish
+				defer wg.Done()
+				if err := e.submissionServer.Shutdown(ctx); err != nil {
+					log.Println("Submission shutdown error:", err)
+				}
+			}()
+		}
 		if e.smtpServer != nil {
 			wg.Add(1)
 			go func() {
@@ -117,10 +222,16 @@ func (e *Engine) Shutdown(ctx context.Context) {
 			}()
 			wg.Add(1)
 			go func() {
-				// Wait for Outgoing Queue to Complete
+				// Wait for Outgoing Workers to Complete
 				defer wg.Done()
-				close(e.outgoingQueue)
+				e.outgoingQueue.close()
 				e.activeWorkers.Wait()
+				e.outgoingPool.close()
+				if e.OutgoingQueueStore != nil {
+					if err := e.OutgoingQueueStore.Close(); err != nil {
+						log.Println("Queue shutdown error:", err)
+					}
+				}
 			}()
 		}
 		wg.Wait()
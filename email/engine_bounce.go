@@ -0,0 +1,267 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Send a failure notification (RFC 3464) for every recipient which
+// bounced since the given statuses were recorded
+func (e *Engine) notifyBounced(item *QueueItem, previous []DeliveryStatus) {
+	if !e.notifiable(item) {
+		return
+	}
+	bounced := []DeliveryResult{}
+	for i, r := range item.Results {
+		if r.Status == DeliveryBounced && previous[i] != DeliveryBounced {
+			bounced = append(bounced, r)
+		}
+	}
+	if len(bounced) > 0 {
+		e.sendNotification(item, "failed", bounced)
+	}
+}
+
+// Send a delay notification for every deferred recipient once the email has
+// been waiting for longer than the next interval in OutgoingDelayNotify
+func (e *Engine) notifyDelayed(item *QueueItem) {
+	if !e.notifiable(item) || item.DelayNotice >= len(e.OutgoingDelayNotify) {
+		return
+	}
+	if time.Since(item.since()) < e.OutgoingDelayNotify[item.DelayNotice] {
+		return
+	}
+	item.DelayNotice++
+	deferred := []DeliveryResult{}
+	for _, r := range item.Results {
+		if r.Status == DeliveryDeferred {
+			deferred = append(deferred, r)
+		}
+	}
+	if len(deferred) > 0 {
+		e.sendNotification(item, "delayed", deferred)
+	}
+}
+
+// Returns the address delivery status notifications are sent from
+func (e *Engine) mailerDaemon() string {
+	return "MAILER-DAEMON@" + e.Domain
+}
+
+// Returns true if delivery status notifications may be sent for an email.
+// Notifications, emails to or from our MAILER-DAEMON and automatic replies
+// never get one (RFC 3834 Section 2), otherwise two systems could keep
+// replying to each other forever.
+func (e *Engine) notifiable(item *QueueItem) bool {
+	if !e.OutgoingBounceNotify || item.Bounce || item.Email.AutoSubmitted() {
+		return false
+	}
+	daemon := e.mailerDaemon()
+	if strings.EqualFold(item.Email.From.Address, daemon) {
+		return false
+	}
+	for _, a := range item.Email.Recipients() {
+		if strings.EqualFold(a.Address, daemon) {
+			return false
+		}
+	}
+	if item.Raw != nil {
+		fields, _ := splitMessage(item.Raw)
+		for _, f := range fields {
+			if strings.EqualFold(f.name, "Auto-Submitted") && isAutoSubmitted(f.value()) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Generate a delivery status notification and route it to the bounce inbox
+// if one is configured, otherwise it is queued for the original sender
+func (e *Engine) sendNotification(item *QueueItem, action string, results []DeliveryResult) {
+	report, err := e.buildNotification(item, action, results)
+	if err != nil {
+		e.ErrorLogger(fmt.Errorf("cannot build delivery status notification: %s", err))
+		return
+	}
+
+	// Deliver to Bounce Inbox
+	if e.OutgoingBounceInbox != "" {
+		handler, ok := e.inbox(e.OutgoingBounceInbox)
+		if !ok {
+			e.ErrorLogger(fmt.Errorf("bounce inbox is not registered: %s", e.OutgoingBounceInbox))
+			return
+		}
+		email, err := newEmailFromRaw(report.Raw)
+		if err != nil {
+			e.ErrorLogger(fmt.Errorf("delivery status notification %s", err))
+			return
+		}
+		email.ID = report.ID
+		email.MessageID = report.Email.MessageID
+		if err := handler(email); err != nil {
+			e.ErrorLogger(fmt.Errorf("bounce inbox handler encountered an error: %s", err))
+		}
+		return
+	}
+
+	// Return to Sender
+	store, err := e.openQueueStore()
+	if err != nil {
+		e.ErrorLogger(err)
+		return
+	}
+	if err := store.Put(report); err != nil {
+		e.ErrorLogger(fmt.Errorf("cannot persist delivery status notification: %s", err))
+		return
+	}
+	e.updateStatus(report, "")
+	e.outgoingQueue.push(report)
+}
+
+// Render a multipart/report containing a human readable explanation, the
+// machine readable delivery status and the headers of the original email
+func (e *Engine) buildNotification(item *QueueItem, action string, results []DeliveryResult) (*QueueItem, error) {
+	id := newQueueID()
+	now := time.Now()
+	email := &Email{
+		ID:        id,
+		MessageID: fmt.Sprint(id, "@", e.Domain),
+		From:      Address{Name: "Mail Delivery System", Address: e.mailerDaemon()},
+		To:        []Address{item.Email.From},
+		Subject:   "Undelivered Mail Returned to Sender",
+	}
+	if action == "delayed" {
+		email.Subject = "Delayed Mail (still being retried)"
+	}
+
+	// Human Readable Explanation
+	var explanation strings.Builder
+	fmt.Fprintf(&explanation, "This is the mail system at %s.\r\n\r\n", e.Domain)
+	if action == "delayed" {
+		fmt.Fprintf(&explanation, "Your message could not be delivered to the following recipients yet,\r\n")
+		fmt.Fprintf(&explanation, "delivery will be retried until %s.\r\n\r\n", item.since().Add(e.OutgoingMaxQueueAge).Format(time.RFC1123Z))
+	} else {
+		fmt.Fprintf(&explanation, "Your message could not be delivered to the following recipients,\r\n")
+		fmt.Fprintf(&explanation, "this is a permanent error and delivery will not be retried.\r\n\r\n")
+	}
+	for _, r := range results {
+		fmt.Fprintf(&explanation, "<%s>: %s\r\n", r.Recipient, describeResult(r))
+	}
+	email.Content = explanation.String()
+
+	// Machine Readable Delivery Status
+	var status strings.Builder
+	fmt.Fprintf(&status, "Reporting-MTA: dns; %s\r\n", e.Domain)
+	fmt.Fprintf(&status, "Arrival-Date: %s\r\n", item.QueuedAt.Format(time.RFC1123Z))
+	for _, r := range results {
+		code := r.EnhancedCode
+		if code == "" && action == "delayed" {
+			code = "4.0.0"
+		} else if code == "" {
+			code = "5.0.0"
+		}
+		fmt.Fprintf(&status, "\r\nFinal-Recipient: rfc822; %s\r\n", r.Recipient)
+		fmt.Fprintf(&status, "Action: %s\r\n", action)
+		fmt.Fprintf(&status, "Status: %s\r\n", code)
+		if r.Host != "" {
+			fmt.Fprintf(&status, "Remote-MTA: dns; %s\r\n", r.Host)
+		}
+		if r.Code != 0 {
+			fmt.Fprintf(&status, "Diagnostic-Code: smtp; %s\r\n", describeResult(r))
+		}
+		if !r.LastAttempt.IsZero() {
+			fmt.Fprintf(&status, "Last-Attempt-Date: %s\r\n", r.LastAttempt.Format(time.RFC1123Z))
+		}
+		if action == "delayed" {
+			fmt.Fprintf(&status, "Will-Retry-Until: %s\r\n", item.since().Add(e.OutgoingMaxQueueAge).Format(time.RFC1123Z))
+		}
+	}
+
+	// Original Headers
+	original := item.Raw
+	if original == nil {
+		var err error
+		addressees := []Address{{Address: results[0].Recipient}}
+		if original, err = e.buildMessage(item.Email, addressees); err != nil {
+			return nil, err
+		}
+	}
+	headers := original
+	if i := bytes.Index(original, []byte("\r\n\r\n")); i >= 0 {
+		headers = original[:i+2]
+	}
+
+	// Assemble Report
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	parts := []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=utf-8", []byte(explanation.String())},
+		{"message/delivery-status", []byte(status.String())},
+		{"text/rfc822-headers", headers},
+	}
+	for _, p := range parts {
+		w, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {p.contentType}})
+		if err != nil {
+			return nil, err
+		}
+		w.Write(p.content)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var raw bytes.Buffer
+	fmt.Fprintf(&raw, "From: %s\r\n", formatAddress(email.From))
+	fmt.Fprintf(&raw, "To: %s\r\n", formatAddress(email.To[0]))
+	fmt.Fprintf(&raw, "Subject: %s\r\n", email.Subject)
+	fmt.Fprintf(&raw, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&raw, "Message-ID: <%s>\r\n", email.MessageID)
+	if item.Email.MessageID != "" {
+		fmt.Fprintf(&raw, "In-Reply-To: <%s>\r\n", item.Email.MessageID)
+		fmt.Fprintf(&raw, "References: <%s>\r\n", item.Email.MessageID)
+	}
+	fmt.Fprintf(&raw, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&raw, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&raw, "Content-Type: multipart/report; report-type=delivery-status; boundary=%q\r\n", mw.Boundary())
+	fmt.Fprintf(&raw, "\r\n")
+	raw.Write(body.Bytes())
+
+	return &QueueItem{
+		ID:          id,
+		Email:       email,
+		QueuedAt:    now,
+		NextAttempt: now,
+		Results:     newDeliveryResults(email),
+		Raw:         raw.Bytes(),
+		Bounce:      true,
+	}, nil
+}
+
+// Format a Delivery Result as an SMTP reply (e.g. 550 5.1.1 User unknown)
+func describeResult(r DeliveryResult) string {
+	parts := []string{}
+	if r.Code != 0 {
+		parts = append(parts, fmt.Sprint(r.Code))
+	}
+	if r.EnhancedCode != "" {
+		parts = append(parts, r.EnhancedCode)
+	}
+	if r.Message != "" {
+		parts = append(parts, r.Message)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Format an Address for use in a header, encoding the name if required
+func formatAddress(a Address) string {
+	return (&mail.Address{Name: a.Name, Address: a.Address}).String()
+}
@@ -25,18 +25,43 @@ func DefaultAuthHandler(r *http.Request) bool {
 func New(domain string) Engine {
 	return Engine{
 		Domain:                domain,
+		Resolver:              NewCachingResolver(net.DefaultResolver),
 		OutgoingWorkerCount:   runtime.NumCPU(),
 		OutgoingTimeout:       30 * time.Second,
-		outgoingQueue:         make(chan *Email, 1024),
+		OutgoingPort:          25,
+		OutgoingDialer:        (&net.Dialer{}).DialContext,
+		OutgoingTLSPolicy:     TLSOpportunistic,
+		OutgoingRetryInterval: time.Minute,
+		OutgoingRetryMaximum:  time.Hour,
+		OutgoingMaxQueueAge:   5 * 24 * time.Hour,
+		OutgoingQueueSize:     1024,
+		OutgoingQueuePath:     "outgoing.wal",
+		OutgoingPoolSize:      2,
+		OutgoingPoolTimeout:   30 * time.Second,
+		outgoingPool:          newSessionPool(),
+		outgoingLimiter:       newRateLimiter(),
+		outgoingQueue:         newOutgoingQueue(),
+		OutgoingStatusStore:   NewMemoryStatusStore(7 * 24 * time.Hour),
+		OutgoingBounceNotify:  true,
 		outgoingMiddleware:    []HandlerMiddleware{},
 		OutgoingSelectorName:  "default",
 		IncomingValidateDKIM:  true,
+		IncomingValidateSPF:   true,
+		IncomingSPFActions: map[SPFResult]SPFAction{
+			SPFFail:      SPFReject,
+			SPFTempError: SPFDefer,
+		},
+		IncomingValidateDMARC: true,
+		IncomingDMARCReject:   true,
+		IncomingValidateARC:   true,
 		IncomingMaxRecipients: 5,
 		IncomingMaxBytes:      10 << 20,
 		IncomingTimeout:       30 * time.Second,
 		incomingMiddleware:    []HandlerMiddleware{},
+		SubmissionRecipients:  100,
 		AuthHandler:           DefaultAuthHandler,
 		ErrorLogger:           DefaultErrorLogger,
 		inboxes:               make(map[string]HandlerEmail),
+		domains:               make(map[string][]DKIMSigner),
 	}
 }
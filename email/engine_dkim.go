@@ -0,0 +1,125 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// A private key used to sign outgoing emails, published in DNS as
+// a TXT record at {Selector}._domainkey.{Domain}
+type DKIMSigner struct {
+	Selector string        // DKIM Selector
+	Key      crypto.Signer // RSA (rsa-sha256) or Ed25519 (ed25519-sha256) Private Key
+	Domain   string        // Signing Domain (Defaults to the engine domain)
+}
+
+// Returns every key outgoing emails from a domain should be signed with
+func (e *Engine) dkimSigners(domain string) []DKIMSigner {
+	if !strings.EqualFold(domain, e.Domain) {
+		return e.domains[strings.ToLower(domain)]
+	}
+	signers := make([]DKIMSigner, 0, len(e.OutgoingDKIMSigners)+1)
+	if e.outgoingDKIMSigner != nil {
+		signers = append(signers, DKIMSigner{Selector: e.OutgoingSelectorName, Key: e.outgoingDKIMSigner})
+	}
+	return append(signers, e.OutgoingDKIMSigners...)
+}
+
+// Parse a canonicalization as written in the c= tag, e.g. "relaxed/simple".
+// The body canonicalization defaults to simple when omitted.
+func parseCanonicalization(s string) (header, body dkim.Canonicalization, err error) {
+	if s == "" {
+		return dkim.CanonicalizationSimple, dkim.CanonicalizationSimple, nil
+	}
+	h, b, ok := strings.Cut(strings.ToLower(s), "/")
+	if !ok {
+		b = string(dkim.CanonicalizationSimple)
+	}
+	for _, c := range []string{h, b} {
+		if c != string(dkim.CanonicalizationSimple) && c != string(dkim.CanonicalizationRelaxed) {
+			return "", "", fmt.Errorf("unknown dkim canonicalization: %s", c)
+		}
+	}
+	return dkim.Canonicalization(h), dkim.Canonicalization(b), nil
+}
+
+// Check the DKIM configuration of the engine, so mistakes are
+// caught on startup rather than for every outgoing email
+func (e *Engine) validateDKIM() error {
+	if _, _, err := parseCanonicalization(e.OutgoingDKIMCanonical); err != nil {
+		return err
+	}
+	if e.OutgoingDKIMHeaders != nil && !slices.ContainsFunc(e.OutgoingDKIMHeaders, func(h string) bool {
+		return strings.EqualFold(h, "From")
+	}) {
+		return fmt.Errorf("dkim signed headers must include From")
+	}
+	for _, domain := range append(slices.Collect(maps.Keys(e.domains)), e.Domain) {
+		for _, s := range e.dkimSigners(domain) {
+			if s.Selector == "" || s.Key == nil {
+				return fmt.Errorf("dkim signer for %s is missing a selector or key", domain)
+			}
+		}
+	}
+	return nil
+}
+
+// Sign an envelope with every key configured for the sender domain, each
+// signature covers the original message so they can be verified independently
+func (e *Engine) signEnvelope(envelope []byte, domain string) ([]byte, error) {
+	now := time.Now()
+	signers := e.dkimSigners(domain)
+	signers = append(signers, e.OutgoingDKIMKeyring.active(strings.ToLower(domain), now)...)
+	if strings.EqualFold(domain, e.Domain) {
+		signers = append(signers, e.OutgoingDKIMKeyring.active("", now)...)
+	}
+	if len(signers) == 0 {
+		// inb4 marked as spam or rejected
+		return envelope, nil
+	}
+	header, body, err := parseCanonicalization(e.OutgoingDKIMCanonical)
+	if err != nil {
+		return nil, err
+	}
+	var expiration time.Time
+	if e.OutgoingDKIMExpiry > 0 {
+		expiration = now.Add(e.OutgoingDKIMExpiry)
+	}
+
+	var signatures bytes.Buffer
+	for _, s := range signers {
+		domain := s.Domain
+		if domain == "" {
+			domain = e.Domain
+		}
+		signer, err := dkim.NewSigner(&dkim.SignOptions{
+			Domain:                 domain,
+			Selector:               s.Selector,
+			Signer:                 s.Key,
+			HeaderCanonicalization: header,
+			BodyCanonicalization:   body,
+			HeaderKeys:             e.OutgoingDKIMHeaders,
+			Expiration:             expiration,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot sign outbound email: %s", err)
+		}
+		if _, err := signer.Write(envelope); err != nil {
+			signer.Close()
+			return nil, fmt.Errorf("cannot sign outbound email: %s", err)
+		}
+		if err := signer.Close(); err != nil {
+			return nil, fmt.Errorf("cannot sign outbound email: %s", err)
+		}
+		signatures.WriteString(signer.Signature())
+	}
+	signatures.Write(envelope)
+	return signatures.Bytes(), nil
+}
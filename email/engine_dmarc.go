@@ -0,0 +1,145 @@
+package email
+
+import (
+	"context"
+	"errors"
+	mathrand "math/rand/v2"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+// The result of a DMARC evaluation (RFC 7489)
+type DMARCResult string
+
+const (
+	DMARCNone      DMARCResult = "none"      // The sender publishes no policy
+	DMARCPass      DMARCResult = "pass"      // SPF or DKIM passed with an aligned domain
+	DMARCFail      DMARCResult = "fail"      // Neither SPF or DKIM passed with an aligned domain
+	DMARCTempError DMARCResult = "temperror" // The policy could not be retrieved
+	DMARCPermError DMARCResult = "permerror" // The policy is malformed
+)
+
+// The action requested by a sender's DMARC policy
+type DMARCPolicy string
+
+const (
+	DMARCPolicyNone       DMARCPolicy = "none"
+	DMARCPolicyQuarantine DMARCPolicy = "quarantine"
+	DMARCPolicyReject     DMARCPolicy = "reject"
+)
+
+// The outcome of evaluating an incoming email against the DMARC policy of its From domain
+type DMARCCheck struct {
+	Result      DMARCResult // Result of the evaluation
+	Domain      string      // Domain of the From header
+	PolicyFound string      // Domain the policy was found on, the organizational domain if inherited
+	Policy      DMARCPolicy // Policy published by the sender
+	Disposition DMARCPolicy // Policy applied to this email after sampling, none unless it failed
+	SPFAligned  bool        // SPF passed for a domain aligned with the From domain
+	DKIMAligned bool        // A DKIM signature passed for a domain aligned with the From domain
+}
+
+var errDMARCTemporary = errors.New("temporary dns error")
+
+// Returns the organizational domain of a domain, e.g. "mail.example.co.uk" is "example.co.uk"
+func organizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(strings.TrimSuffix(domain, ".")))
+	if err != nil {
+		return strings.ToLower(domain)
+	}
+	return org
+}
+
+// Reports whether two domains are aligned, relaxed alignment only requires
+// them to share an organizational domain
+func dmarcAligned(a, b string, mode dmarc.AlignmentMode) bool {
+	if mode == dmarc.AlignmentStrict {
+		return strings.EqualFold(a, b)
+	}
+	return organizationalDomain(a) == organizationalDomain(b)
+}
+
+// Evaluate the DMARC policy of the From domain of an incoming email
+// using the results of the SPF and DKIM checks
+func (e *Engine) checkDMARC(ctx context.Context, from string, spf *SPFCheck, verifications []*dkim.Verification) *DMARCCheck {
+	check := &DMARCCheck{Domain: domainOf(from), Disposition: DMARCPolicyNone}
+	if check.Domain == "" {
+		check.Result = DMARCPermError
+		return check
+	}
+
+	// Find Policy
+	// 	Falling back to the organizational domain if the From domain has none
+	record, found, err := e.lookupDMARC(ctx, check.Domain)
+	if errors.Is(err, dmarc.ErrNoPolicy) {
+		if org := organizationalDomain(check.Domain); org != check.Domain {
+			record, found, err = e.lookupDMARC(ctx, org)
+		}
+	}
+	switch {
+	case errors.Is(err, dmarc.ErrNoPolicy):
+		check.Result = DMARCNone
+		return check
+	case errors.Is(err, errDMARCTemporary):
+		check.Result = DMARCTempError
+		return check
+	case err != nil:
+		check.Result = DMARCPermError
+		return check
+	}
+	check.PolicyFound = found
+	check.Policy = DMARCPolicy(record.Policy)
+	if found != check.Domain && record.SubdomainPolicy != "" {
+		check.Policy = DMARCPolicy(record.SubdomainPolicy)
+	}
+
+	// Check Alignment
+	if spf != nil && spf.Result == SPFPass {
+		check.SPFAligned = dmarcAligned(spf.Domain, check.Domain, record.SPFAlignment)
+	}
+	for _, v := range verifications {
+		if v.Err == nil && dmarcAligned(v.Domain, check.Domain, record.DKIMAlignment) {
+			check.DKIMAligned = true
+		}
+	}
+	if check.SPFAligned || check.DKIMAligned {
+		check.Result = DMARCPass
+		return check
+	}
+	check.Result = DMARCFail
+
+	// Apply Policy
+	// 	Emails outside of the sampled percentage get the next weakest policy
+	check.Disposition = check.Policy
+	if record.Percent != nil && mathrand.IntN(100) >= *record.Percent {
+		switch check.Policy {
+		case DMARCPolicyReject:
+			check.Disposition = DMARCPolicyQuarantine
+		case DMARCPolicyQuarantine:
+			check.Disposition = DMARCPolicyNone
+		}
+	}
+	return check
+}
+
+// Lookup the DMARC record of a domain using the engine resolver
+func (e *Engine) lookupDMARC(ctx context.Context, domain string) (*dmarc.Record, string, error) {
+	var lookupErr error
+	record, err := dmarc.LookupWithOptions(domain, &dmarc.LookupOptions{
+		LookupTXT: func(name string) ([]string, error) {
+			txts, err := e.Resolver.LookupTXT(ctx, name)
+			if isNotFound(err) {
+				return nil, nil
+			}
+			lookupErr = err
+			return txts, err
+		},
+	})
+	if lookupErr != nil {
+		return nil, domain, errDMARCTemporary
+	}
+	return record, domain, err
+}
@@ -0,0 +1,172 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+func TestOrganizationalDomain(t *testing.T) {
+	tests := map[string]string{
+		"example.com":           "example.com",
+		"mail.example.com":      "example.com",
+		"a.b.mail.example.com.": "example.com",
+		"mail.example.co.uk":    "example.co.uk",
+		"Mail.Example.COM":      "example.com",
+	}
+	for domain, want := range tests {
+		if got := organizationalDomain(domain); got != want {
+			t.Errorf("%s: got %s, want %s", domain, got, want)
+		}
+	}
+}
+
+func TestDMARC(t *testing.T) {
+	tests := []struct {
+		name        string
+		records     map[string][]string
+		from        string
+		spf         *SPFCheck
+		dkimDomains []string
+		result      DMARCResult
+		policy      DMARCPolicy
+		disposition DMARCPolicy
+	}{
+		{
+			name:    "no policy",
+			records: map[string][]string{},
+			from:    "user@example.com",
+			spf:     &SPFCheck{Result: SPFFail, Domain: "example.com"},
+			result:  DMARCNone, disposition: DMARCPolicyNone,
+		},
+		{
+			name:    "spf aligned",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+			from:    "user@example.com",
+			spf:     &SPFCheck{Result: SPFPass, Domain: "example.com"},
+			result:  DMARCPass, policy: DMARCPolicyReject, disposition: DMARCPolicyNone,
+		},
+		{
+			name:    "spf relaxed alignment",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+			from:    "user@example.com",
+			spf:     &SPFCheck{Result: SPFPass, Domain: "bounces.example.com"},
+			result:  DMARCPass, policy: DMARCPolicyReject, disposition: DMARCPolicyNone,
+		},
+		{
+			name:    "spf strict alignment",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject; aspf=s"}},
+			from:    "user@example.com",
+			spf:     &SPFCheck{Result: SPFPass, Domain: "bounces.example.com"},
+			result:  DMARCFail, policy: DMARCPolicyReject, disposition: DMARCPolicyReject,
+		},
+		{
+			name:    "spf unaligned",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=quarantine"}},
+			from:    "user@example.com",
+			spf:     &SPFCheck{Result: SPFPass, Domain: "example.net"},
+			result:  DMARCFail, policy: DMARCPolicyQuarantine, disposition: DMARCPolicyQuarantine,
+		},
+		{
+			name:        "dkim relaxed alignment",
+			records:     map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+			from:        "user@mail.example.com",
+			spf:         &SPFCheck{Result: SPFFail, Domain: "example.net"},
+			dkimDomains: []string{"example.com"},
+			result:      DMARCPass, policy: DMARCPolicyReject, disposition: DMARCPolicyNone,
+		},
+		{
+			name:        "dkim strict alignment",
+			records:     map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject; adkim=s"}},
+			from:        "user@example.com",
+			dkimDomains: []string{"mail.example.com"},
+			result:      DMARCFail, policy: DMARCPolicyReject, disposition: DMARCPolicyReject,
+		},
+		{
+			name:    "organizational domain",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+			from:    "user@mail.example.com",
+			result:  DMARCFail, policy: DMARCPolicyReject, disposition: DMARCPolicyReject,
+		},
+		{
+			name:    "organizational domain subdomain policy",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject; sp=quarantine"}},
+			from:    "user@mail.example.com",
+			result:  DMARCFail, policy: DMARCPolicyQuarantine, disposition: DMARCPolicyQuarantine,
+		},
+		{
+			name:    "subdomain policy ignored on organizational domain",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject; sp=none"}},
+			from:    "user@example.com",
+			result:  DMARCFail, policy: DMARCPolicyReject, disposition: DMARCPolicyReject,
+		},
+		{
+			name: "own policy preferred",
+			records: map[string][]string{
+				"_dmarc.example.com":      {"v=DMARC1; p=reject"},
+				"_dmarc.mail.example.com": {"v=DMARC1; p=none"},
+			},
+			from:   "user@mail.example.com",
+			result: DMARCFail, policy: DMARCPolicyNone, disposition: DMARCPolicyNone,
+		},
+		{
+			name:    "sampled out reject",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject; pct=0"}},
+			from:    "user@example.com",
+			result:  DMARCFail, policy: DMARCPolicyReject, disposition: DMARCPolicyQuarantine,
+		},
+		{
+			name:    "sampled out quarantine",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=quarantine; pct=0"}},
+			from:    "user@example.com",
+			result:  DMARCFail, policy: DMARCPolicyQuarantine, disposition: DMARCPolicyNone,
+		},
+		{
+			name:    "sampled in",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject; pct=100"}},
+			from:    "user@example.com",
+			result:  DMARCFail, policy: DMARCPolicyReject, disposition: DMARCPolicyReject,
+		},
+		{
+			name:    "malformed policy",
+			records: map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=bogus"}},
+			from:    "user@example.com",
+			result:  DMARCPermError, disposition: DMARCPolicyNone,
+		},
+		{
+			name:    "no from domain",
+			records: map[string][]string{},
+			from:    "",
+			result:  DMARCPermError, disposition: DMARCPolicyNone,
+		},
+		{
+			name:    "temporary error",
+			records: map[string][]string{},
+			from:    "user@broken.example.com",
+			result:  DMARCTempError, disposition: DMARCPolicyNone,
+		},
+	}
+	for _, test := range tests {
+		e := New("mx.example.net")
+		e.Resolver = &testResolver{
+			txt:  test.records,
+			fail: map[string]bool{"_dmarc.broken.example.com": true},
+		}
+		verifications := []*dkim.Verification{
+			{Domain: "example.org"},
+			{Domain: domainOf(test.from), Err: errors.New("signature did not verify")},
+		}
+		for _, domain := range test.dkimDomains {
+			verifications = append(verifications, &dkim.Verification{Domain: domain})
+		}
+		check := e.checkDMARC(context.Background(), test.from, test.spf, verifications)
+		if check.Result != test.result || check.Policy != test.policy || check.Disposition != test.disposition {
+			t.Errorf("%s: got %s %q %q, want %s %q %q", test.name,
+				check.Result, check.Policy, check.Disposition,
+				test.result, test.policy, test.disposition,
+			)
+		}
+	}
+}
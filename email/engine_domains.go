@@ -0,0 +1,73 @@
+package email
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Register an additional domain hosted by the engine. Inboxes can be registered
+// on the domain by their full address, and outgoing emails sent from the domain
+// are signed with the given DKIM keys. Signers without a Domain sign as this domain.
+func (e *Engine) RegisterDomain(domain string, signers ...DKIMSigner) error {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" || e.HostsDomain(domain) {
+		return fmt.Errorf("domain is empty or already registered: %s", domain)
+	}
+	for i := range signers {
+		if signers[i].Domain == "" {
+			signers[i].Domain = domain
+		}
+	}
+	e.domains[domain] = signers
+	return nil
+}
+
+// Returns true if the domain is Engine.Domain or was registered with RegisterDomain
+func (e *Engine) HostsDomain(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == strings.ToLower(e.Domain) {
+		return true
+	}
+	_, ok := e.domains[domain]
+	return ok
+}
+
+// Returns the lowercased domain of an email address
+func domainOf(address string) string {
+	if i := strings.LastIndexByte(address, '@'); i >= 0 {
+		return strings.ToLower(address[i+1:])
+	}
+	return ""
+}
+
+// Normalize an address for use as an inbox key, the local part is left
+// alone but domains are case insensitive
+func inboxAddress(address string) string {
+	if i := strings.LastIndexByte(address, '@'); i >= 0 {
+		return address[:i+1] + strings.ToLower(address[i+1:])
+	}
+	return address
+}
+
+// Returns the handler for an inbox address
+func (e *Engine) inbox(address string) (HandlerEmail, bool) {
+	handler, ok := e.inboxes[inboxAddress(address)]
+	return handler, ok
+}
+
+// Check an outgoing email is sent from a domain hosted by the engine
+func (e *Engine) validateSender(email *Email) error {
+	if domain := domainOf(email.From.Address); !e.HostsDomain(domain) {
+		return fmt.Errorf("sender domain is not hosted by this engine: %s", domain)
+	}
+	return nil
+}
+
+// Returns the domain used for Message-IDs generated for an email,
+// matching the sender so replies stay with the right brand
+func (e *Engine) messageIDDomain(email *Email) string {
+	if domain := domainOf(email.From.Address); domain != "" && e.HostsDomain(domain) {
+		return domain
+	}
+	return e.Domain
+}
@@ -2,9 +2,12 @@ package email
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/mail"
+	"net/textproto"
+	"strings"
 
 	"github.com/emersion/go-msgauth/dkim"
 	"github.com/emersion/go-smtp"
@@ -16,9 +19,17 @@ func (e *Engine) UseIncoming(handler HandlerMiddleware) {
 	e.incomingMiddleware = append(e.incomingMiddleware, handler)
 }
 
-// Register an Inbox to Handle Incoming Emails
+// Register an Inbox to Handle Incoming Emails, either by username on
+// Engine.Domain or by full address on any domain hosted by the engine
 func (e *Engine) RegisterInbox(username string, handler HandlerEmail) error {
 	address := fmt.Sprint(username, "@", e.Domain)
+	if strings.Contains(username, "@") {
+		if !e.HostsDomain(domainOf(username)) {
+			return fmt.Errorf("inbox domain is not hosted by this engine: %s", username)
+		}
+		address = username
+	}
+	address = inboxAddress(address)
 	if _, exists := e.inboxes[address]; exists {
 		return fmt.Errorf("an inbox already exists with that username: %s", address)
 	}
@@ -26,7 +37,41 @@ func (e *Engine) RegisterInbox(username string, handler HandlerEmail) error {
 	return nil
 }
 
-func (e *Engine) incomingHandler(r io.Reader) error {
+// Check an envelope recipient can be delivered to before accepting any data,
+// unknown recipients are rejected here rather than after reading the message
+func (e *Engine) checkRecipient(address string) error {
+	if _, ok := e.inbox(address); ok {
+		return nil
+	}
+	if e.RecipientValidator != nil {
+		ok, err := e.RecipientValidator(address)
+		if err != nil {
+			e.ErrorLogger(fmt.Errorf("recipient validator encountered an error: %s", err))
+			return &smtp.SMTPError{
+				Code:         451,
+				EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+				Message:      "Cannot verify recipient, try again later",
+			}
+		}
+		if ok {
+			return nil
+		}
+	}
+	if !e.HostsDomain(domainOf(address)) {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Relaying Denied",
+		}
+	}
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "Unknown Recipient",
+	}
+}
+
+func (e *Engine) incomingHandler(s *Session, r io.Reader) error {
 
 	// Read Incoming Envelope
 	// 	Additionally we need to clone this message otherwise the DKIM Reader
@@ -43,31 +88,117 @@ func (e *Engine) incomingHandler(r io.Reader) error {
 	}
 
 	// Validate Incoming Addresses
-	var emailFrom *mail.Address
-	var emailTo []*mail.Address
-	if emailTo, err = mail.ParseAddressList(envelope.GetHeader("To")); err != nil {
-		e.ErrorLogger(fmt.Errorf("incoming email contains an invalid 'To' header: %s", err))
-		return smtp.ErrDataReset
-	}
-	if emailFrom, err = mail.ParseAddress(envelope.GetHeader("From")); err != nil {
-		e.ErrorLogger(fmt.Errorf("incoming email contains an invalid 'From' header: %s", err))
+	email, err := newEmailFromEnvelope(envelope)
+	if err != nil {
+		e.ErrorLogger(fmt.Errorf("incoming email %s", err))
 		return smtp.ErrDataReset
 	}
-	if len(emailTo) > e.IncomingMaxRecipients {
+	email.MailFrom = s.mailFrom
+	email.RcptTo = s.rcptTo
+	email.Auth = &AuthResults{SPF: s.spf}
+	if len(email.RcptTo) > e.IncomingMaxRecipients {
 		// SMTP Backend should have filtered this out earlier, but we stop it here jic
 		e.ErrorLogger(fmt.Errorf("incoming email includes too many recipients"))
 		return smtp.ErrDataReset
 	}
 
 	// Validate Incoming Signature
-	if e.IncomingValidateDKIM {
-		if _, err := dkim.Verify(bytes.NewReader(body)); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), e.IncomingTimeout)
+	defer cancel()
+	var verifications []*dkim.Verification
+	if e.IncomingValidateDKIM || e.IncomingValidateDMARC {
+		verifications, err = dkim.VerifyWithOptions(bytes.NewReader(body), &dkim.VerifyOptions{
+			LookupTXT: func(domain string) ([]string, error) {
+				return e.Resolver.LookupTXT(ctx, domain)
+			},
+		})
+		if err != nil && e.IncomingValidateDKIM {
 			e.ErrorLogger(fmt.Errorf("incoming email failed dkim signature validation: %s", err))
 			return smtp.ErrDataReset
 		}
+		email.Auth.DKIM = newDKIMChecks(verifications)
+	}
+	if e.IncomingValidateARC {
+		email.Auth.ARC = e.checkARC(ctx, body)
+	}
+
+	// Evaluate Sender Policy
+	// 	Quarantined emails are left for middleware to deal with
+	if e.IncomingValidateDMARC {
+		email.Auth.DMARC = e.checkDMARC(ctx, email.From.Address, s.spf, verifications)
+		if e.IncomingDMARCReject && email.Auth.DMARC.Disposition == DMARCPolicyReject {
+			return &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      fmt.Sprintf("Rejected by DMARC policy for %s", email.Auth.DMARC.Domain),
+			}
+		}
+	}
+	email.Raw = append([]byte(foldHeader("Authentication-Results", email.Auth.Header(e.Domain))), stripAuthResults(body, e.Domain)...)
+
+	// Run Middleware
+	for _, mw := range e.incomingMiddleware {
+		if proceed, err := mw(email); !proceed {
+			if err != nil {
+				e.ErrorLogger(fmt.Errorf("incoming middleware encountered an error: %s", err))
+			}
+			return smtp.ErrDataReset
+		}
 	}
 
-	// Apply Abstraction
+	// Route to Appropriate Inboxes
+	// 	Using the envelope so Bcc'd, mailing list, and forwarded emails arrive
+	receivedBy, unrouted := 0, 0
+	for _, recipient := range email.RcptTo {
+		handler, ok := e.inbox(recipient)
+		if !ok {
+			unrouted++
+			continue
+		}
+		if err := handler(email); err != nil {
+			e.ErrorLogger(fmt.Errorf("inbox handler encountered an error: %s", err))
+			return smtp.ErrDataReset
+		}
+		receivedBy++
+	}
+
+	// Recipients without an inbox were accepted by the RecipientValidator
+	if unrouted > 0 && e.NoInboxHandler != nil {
+		if err := e.NoInboxHandler(email); err != nil {
+			e.ErrorLogger(fmt.Errorf("no inbox handler encountered an error: %s", err))
+			return smtp.ErrDataReset
+		}
+		receivedBy++
+	}
+	if receivedBy == 0 {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "Unknown Recipient",
+		}
+	}
+
+	return nil
+}
+
+// Apply Abstraction to a parsed envelope
+func newEmailFromEnvelope(envelope *enmime.Envelope) (*Email, error) {
+	emailTo, err := parseAddressList(envelope, "To")
+	if err != nil {
+		return nil, err
+	}
+	emailCc, err := parseAddressList(envelope, "Cc")
+	if err != nil {
+		return nil, err
+	}
+	emailFrom, err := mail.ParseAddress(envelope.GetHeader("From"))
+	if err != nil {
+		return nil, fmt.Errorf("contains an invalid 'From' header: %s", err)
+	}
+	emailReplyTo, err := parseAddressList(envelope, "Reply-To")
+	if err != nil {
+		return nil, err
+	}
 	incomingAttachments := make([]Attachment, 0, len(envelope.Attachments)+len(envelope.Inlines))
 	for i := range envelope.Attachments {
 		a := envelope.Attachments[i]
@@ -87,22 +218,31 @@ func (e *Engine) incomingHandler(r io.Reader) error {
 			Inline:      true,
 		})
 	}
-	incomingRecipients := make([]Address, 0, len(emailTo))
-	for _, recipient := range emailTo {
-		incomingRecipients = append(incomingRecipients, Address{
-			Name:    recipient.Name,
-			Address: recipient.Address,
-		})
+	incomingHeaders := make(map[string]string)
+	for _, name := range envelope.GetHeaderKeys() {
+		if !reservedHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+			incomingHeaders[name] = envelope.GetHeader(name)
+		}
 	}
 	email := &Email{
 		From: Address{
 			Address: emailFrom.Address,
 			Name:    emailFrom.Name,
 		},
-		To:          incomingRecipients,
+		To:          emailTo,
+		Cc:          emailCc,
+		Headers:     incomingHeaders,
+		MessageID:   parseMessageID(envelope.GetHeader("Message-ID")),
+		InReplyTo:   parseMessageID(envelope.GetHeader("In-Reply-To")),
+		References:  parseMessageIDs(envelope.GetHeader("References")),
 		Subject:     envelope.GetHeader("Subject"),
+		Text:        envelope.Text,
+		HTMLBody:    envelope.HTML,
 		Attachments: incomingAttachments,
 	}
+	if len(emailReplyTo) > 0 {
+		email.ReplyTo = &emailReplyTo[0]
+	}
 	if envelope.HTML == "" {
 		email.Content = envelope.Text
 		email.HTML = false
@@ -110,41 +250,80 @@ func (e *Engine) incomingHandler(r io.Reader) error {
 		email.Content = envelope.HTML
 		email.HTML = true
 	}
+	return email, nil
+}
 
-	// Run Middleware
-	for _, mw := range e.incomingMiddleware {
-		if proceed, err := mw(email); !proceed {
-			if err != nil {
-				e.ErrorLogger(fmt.Errorf("incoming middleware encountered an error: %s", err))
-			}
-			return smtp.ErrDataReset
-		}
+// Apply Abstraction to a prerendered envelope, parts without a disposition
+// such as those of a delivery status notification are kept as attachments
+func newEmailFromRaw(raw []byte) (*Email, error) {
+	envelope, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("is invalid or malformed: %s", err)
+	}
+	email, err := newEmailFromEnvelope(envelope)
+	if err != nil {
+		return nil, err
 	}
+	for _, p := range envelope.OtherParts {
+		email.Attachments = append(email.Attachments, Attachment{
+			ContentType: p.ContentType,
+			Filename:    p.FileName,
+			Data:        p.Content,
+		})
+	}
+	email.Raw = raw
+	return email, nil
+}
 
-	// Route to Appropriate Inboxes
-	receivedBy := 0
-	for _, recipient := range emailTo {
-		if handler, ok := e.inboxes[recipient.Address]; ok {
-			if err := handler(email); err != nil {
-				e.ErrorLogger(fmt.Errorf("inbox handler encountered an error: %s", err))
-				return smtp.ErrDataReset
-			}
-			receivedBy++
-		}
+// Parse an optional address list header from a parsed envelope
+func parseAddressList(envelope *enmime.Envelope, header string) ([]Address, error) {
+	value := envelope.GetHeader(header)
+	if value == "" {
+		return nil, nil
 	}
-	if receivedBy == 0 {
-		if e.NoInboxHandler != nil {
-			if err := e.NoInboxHandler(email); err != nil {
-				e.ErrorLogger(fmt.Errorf("no inbox handler encountered an error: %s", err))
-				return smtp.ErrDataReset
-			}
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		return nil, fmt.Errorf("contains an invalid '%s' header: %s", header, err)
+	}
+	addresses := make([]Address, 0, len(list))
+	for _, a := range list {
+		addresses = append(addresses, Address{
+			Name:    a.Name,
+			Address: a.Address,
+		})
+	}
+	return addresses, nil
+}
+
+// Parse a single message identifier, returning it without its angle brackets
+func parseMessageID(value string) string {
+	if ids := parseMessageIDs(value); len(ids) > 0 {
+		return ids[0]
+	}
+	return ""
+}
+
+// Parse a list of message identifiers (e.g. "<a@example.org> <b@example.org>"),
+// returning them without their angle brackets
+func parseMessageIDs(value string) []string {
+	ids := []string{}
+	for {
+		start := strings.IndexByte(value, '<')
+		if start < 0 {
+			break
 		}
-		return &smtp.SMTPError{
-			Code:         550,
-			EnhancedCode: smtp.EnhancedCodeNotSet,
-			Message:      "Unknown Recipient",
+		end := strings.IndexByte(value[start:], '>')
+		if end < 0 {
+			break
+		}
+		if id := strings.TrimSpace(value[start+1 : start+end]); id != "" {
+			ids = append(ids, id)
 		}
+		value = value[start+end+1:]
 	}
-
-	return nil
+	if len(ids) == 0 {
+		// Some clients forget the angle brackets entirely
+		return strings.Fields(value)
+	}
+	return ids
 }
@@ -0,0 +1,84 @@
+package email
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestCheckRecipient(t *testing.T) {
+	e := New("example.com")
+	e.ErrorLogger = func(err error) {}
+	e.RegisterInbox("bob", func(email *Email) error { return nil })
+	e.RecipientValidator = func(address string) (bool, error) {
+		switch address {
+		case "catchall@example.com":
+			return true, nil
+		case "broken@example.com":
+			return false, errors.New("directory unavailable")
+		}
+		return false, nil
+	}
+
+	tests := []struct {
+		address string
+		code    int
+	}{
+		{"bob@example.com", 0},
+		{"bob@EXAMPLE.com", 0},
+		{"catchall@example.com", 0},
+		{"alice@example.com", 550},
+		{"broken@example.com", 451},
+		{"bob@example.net", 550},
+	}
+	for _, test := range tests {
+		err := e.checkRecipient(test.address)
+		var smtpErr *smtp.SMTPError
+		if test.code == 0 {
+			if err != nil {
+				t.Errorf("%s: got %v, want accepted", test.address, err)
+			}
+		} else if !errors.As(err, &smtpErr) || smtpErr.Code != test.code {
+			t.Errorf("%s: got %v, want %d", test.address, err, test.code)
+		}
+	}
+}
+
+func TestStartSMTPRequiresNoInboxHandler(t *testing.T) {
+	e := New("example.com")
+	e.RecipientValidator = func(address string) (bool, error) { return true, nil }
+	err := e.StartSMTP("127.0.0.1:0", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "NoInboxHandler") {
+		t.Fatalf("got %v, want an error requiring a NoInboxHandler", err)
+	}
+}
+
+func TestFoldHeader(t *testing.T) {
+	auth := &AuthResults{SPF: &SPFCheck{Result: SPFPass, Identity: "mailfrom", Domain: "example.net"}}
+	for i := 0; i < 40; i++ {
+		auth.DKIM = append(auth.DKIM, DKIMCheck{Result: DKIMFail, Domain: "example.net", Reason: "signature did not verify"})
+	}
+	field := foldHeader("Authentication-Results", auth.Header("example.com"))
+	if !strings.HasPrefix(field, "Authentication-Results: example.com;") || !strings.HasSuffix(field, "\r\n") {
+		t.Fatalf("malformed field: %q", field)
+	}
+	lines := strings.Split(strings.TrimSuffix(field, "\r\n"), "\r\n")
+	if len(lines) < 2 {
+		t.Fatalf("long field was not folded: %q", field)
+	}
+	for i, line := range lines {
+		if len(line) > 78 {
+			t.Errorf("line %d is %d characters long: %q", i, len(line), line)
+		}
+		if i > 0 && !strings.HasPrefix(line, " ") {
+			t.Errorf("continuation line %d does not start with whitespace: %q", i, line)
+		}
+	}
+
+	// Unfolding restores the original value
+	if got := (headerField{raw: field}).value(); got != auth.Header("example.com") {
+		t.Errorf("got %q after unfolding", got)
+	}
+}
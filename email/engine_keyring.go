@@ -0,0 +1,179 @@
+package email
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A DKIM key held by a Keyring, used for signing from its activation until its retirement
+type DKIMKey struct {
+	DKIMSigner
+	ActiveFrom time.Time // Signing starts at this time, the record must be published well before then
+	RetireAt   time.Time // Signing stops at this time, zero to never retire
+}
+
+// A set of DKIM keys rotated on a schedule. Outgoing emails are signed with the most
+// recently activated key for each domain and algorithm, so a new selector can be
+// added ahead of time and signing switches over to it once it becomes active.
+type DKIMKeyring struct {
+	mu   sync.RWMutex
+	keys []DKIMKey
+}
+
+// A DNS TXT record which must be published for a DKIM key
+type DKIMRecord struct {
+	Name       string    // Fully qualified record name, e.g. "default._domainkey.example.org"
+	Value      string    // Record value, providers may need it split into 255 byte strings
+	ActiveFrom time.Time // Copied from the key, zero for keys which are always active
+	RetireAt   time.Time // Copied from the key, the record should stay published a while after
+}
+
+// Create a new Keyring holding the given keys
+func NewDKIMKeyring(keys ...DKIMKey) (*DKIMKeyring, error) {
+	k := &DKIMKeyring{}
+	for _, key := range keys {
+		if err := k.Add(key); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// Add a key to the Keyring, the selector must be unique for its domain
+func (k *DKIMKeyring) Add(key DKIMKey) error {
+	if key.Selector == "" || key.Key == nil {
+		return fmt.Errorf("dkim key is missing a selector or key")
+	}
+	if _, err := dkimAlgorithm(key.Key); err != nil {
+		return err
+	}
+	if !key.RetireAt.IsZero() && !key.RetireAt.After(key.ActiveFrom) {
+		return fmt.Errorf("dkim key '%s' retires before it activates", key.Selector)
+	}
+	key.Domain = strings.ToLower(key.Domain)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, existing := range k.keys {
+		if existing.Domain == key.Domain && existing.Selector == key.Selector {
+			return fmt.Errorf("dkim key '%s' already exists for domain '%s'", key.Selector, key.Domain)
+		}
+	}
+	k.keys = append(k.keys, key)
+	return nil
+}
+
+// Remove a key from the Keyring, returns false if it could not be found.
+// Use an empty domain for keys signing as the engine domain.
+func (k *DKIMKeyring) Remove(domain, selector string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	before := len(k.keys)
+	k.keys = slices.DeleteFunc(k.keys, func(key DKIMKey) bool {
+		return key.Domain == strings.ToLower(domain) && key.Selector == selector
+	})
+	return len(k.keys) != before
+}
+
+// Returns the keys to sign with at the given time for a domain, an empty
+// domain matches keys signing as the engine domain
+func (k *DKIMKeyring) active(domain string, at time.Time) []DKIMSigner {
+	if k == nil {
+		return nil
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	// Newest Key for each Algorithm
+	newest := make(map[string]DKIMKey)
+	for _, key := range k.keys {
+		if key.Domain != domain || at.Before(key.ActiveFrom) || (!key.RetireAt.IsZero() && !at.Before(key.RetireAt)) {
+			continue
+		}
+		algorithm, _ := dkimAlgorithm(key.Key)
+		if current, ok := newest[algorithm]; !ok || key.ActiveFrom.After(current.ActiveFrom) {
+			newest[algorithm] = key
+		}
+	}
+	signers := make([]DKIMSigner, 0, len(newest))
+	for _, algorithm := range []string{"rsa", "ed25519"} {
+		if key, ok := newest[algorithm]; ok {
+			signers = append(signers, key.DKIMSigner)
+		}
+	}
+	return signers
+}
+
+// Returns the name of the key type as written in the k= tag
+func dkimAlgorithm(key any) (string, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		return "rsa", nil
+	case ed25519.PrivateKey, ed25519.PublicKey:
+		return "ed25519", nil
+	default:
+		return "", fmt.Errorf("dkim key must be an rsa or ed25519 key")
+	}
+}
+
+// Build the TXT record advertising the public half of a DKIM key
+func newDKIMRecord(s DKIMSigner, domain string) (DKIMRecord, error) {
+	if s.Domain != "" {
+		domain = s.Domain
+	}
+	algorithm, err := dkimAlgorithm(s.Key)
+	if err != nil {
+		return DKIMRecord{}, err
+	}
+	var public []byte
+	switch v := s.Key.Public().(type) {
+	case ed25519.PublicKey:
+		// RFC 8463 publishes the raw key rather than a SubjectPublicKeyInfo
+		public = v
+	default:
+		if public, err = x509.MarshalPKIXPublicKey(v); err != nil {
+			return DKIMRecord{}, fmt.Errorf("cannot encode dkim public key: %s", err)
+		}
+	}
+	return DKIMRecord{
+		Name:  fmt.Sprint(s.Selector, "._domainkey.", domain),
+		Value: fmt.Sprint("v=DKIM1; k=", algorithm, "; p=", base64.StdEncoding.EncodeToString(public)),
+	}, nil
+}
+
+// Returns the DNS TXT records for every DKIM key known to the engine, including
+// keys in the Keyring which have yet to activate or have already retired.
+// Records for upcoming keys must be published before they become active.
+func (e *Engine) DKIMRecords() ([]DKIMRecord, error) {
+	records := []DKIMRecord{}
+	for _, domain := range append([]string{e.Domain}, slices.Sorted(maps.Keys(e.domains))...) {
+		for _, s := range e.dkimSigners(domain) {
+			record, err := newDKIMRecord(s, domain)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+	}
+	if e.OutgoingDKIMKeyring != nil {
+		e.OutgoingDKIMKeyring.mu.RLock()
+		defer e.OutgoingDKIMKeyring.mu.RUnlock()
+		for _, key := range e.OutgoingDKIMKeyring.keys {
+			record, err := newDKIMRecord(key.DKIMSigner, e.Domain)
+			if err != nil {
+				return nil, err
+			}
+			record.ActiveFrom, record.RetireAt = key.ActiveFrom, key.RetireAt
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
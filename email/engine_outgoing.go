@@ -2,13 +2,15 @@ package email
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"net"
-	"net/smtp"
-	"sort"
+	"maps"
+	"net/textproto"
+	"slices"
 	"strings"
+	"time"
 
-	"github.com/emersion/go-msgauth/dkim"
+	"github.com/jaytaylor/html2text"
 	"github.com/jhillyerd/enmime"
 )
 
@@ -18,123 +20,544 @@ func (e *Engine) UseOutgoing(handler HandlerMiddleware) {
 }
 
 // Queue an Outgoing Email, returns false if email was dropped for being full
+// or could not be persisted to the Queue Store. On success the email is assigned
+// an ID which can be used to query its delivery status or cancel it.
+// Emails with SendAt set are held in the queue until then.
 func (e *Engine) QueueEmail(email *Email) bool {
-	select {
-	case e.outgoingQueue <- email:
-		return true
-	default:
+	return e.queueEmail(email, nil)
+}
+
+// Queue an Outgoing Email, sending the prerendered envelope instead if provided
+func (e *Engine) queueEmail(email *Email, raw []byte) bool {
+	store, err := e.openQueueStore()
+	if err != nil {
+		e.ErrorLogger(err)
+		return false
+	}
+	if e.outgoingQueue.len() >= e.OutgoingQueueSize {
+		return false
+	}
+	email.ID = newQueueID()
+	if email.MessageID == "" {
+		email.MessageID = fmt.Sprint(email.ID, "@", e.messageIDDomain(email))
+	}
+	item := &QueueItem{
+		ID:          email.ID,
+		Email:       email,
+		QueuedAt:    time.Now(),
+		NextAttempt: time.Now(),
+		Results:     newDeliveryResults(email),
+		Raw:         raw,
+		Auth:        email.Auth,
+	}
+	if email.SendAt.After(item.NextAttempt) {
+		item.NextAttempt = email.SendAt
+	}
+	if err := store.Put(item); err != nil {
+		e.ErrorLogger(fmt.Errorf("cannot persist outgoing email: %s", err))
 		return false
 	}
+	e.updateStatus(item, "")
+	e.outgoingQueue.push(item)
+	return true
+}
+
+// An error encountered while delivering an outgoing email.
+// Permanent errors (5xx replies, malformed emails) should not be retried,
+// all other errors (4xx replies, network and DNS failures) are transient.
+type DeliveryError struct {
+	Permanent    bool
+	Code         int           // SMTP Reply Code if known
+	EnhancedCode string        // Enhanced Status Code if known
+	RetryAfter   time.Duration // Set if every deferred recipient was throttled by a rate limit
+	Err          error
+}
+
+func (d *DeliveryError) Error() string {
+	return d.Err.Error()
+}
+
+func (d *DeliveryError) Unwrap() error {
+	return d.Err
+}
+
+func permanentError(format string, a ...any) error {
+	return &DeliveryError{Permanent: true, Err: fmt.Errorf(format, a...)}
+}
+
+func transientError(format string, a ...any) error {
+	return &DeliveryError{Permanent: false, Err: fmt.Errorf(format, a...)}
+}
+
+// Create a pending Delivery Result for each recipient of an email
+func newDeliveryResults(email *Email) []DeliveryResult {
+	recipients := email.Recipients()
+	results := make([]DeliveryResult, 0, len(recipients))
+	for _, addressee := range recipients {
+		results = append(results, DeliveryResult{
+			Recipient: addressee.Address,
+			Status:    DeliveryQueued,
+		})
+	}
+	return results
+}
+
+// Bypass the Outbound Email Queue and Send an Email Immediately.
+// A result is returned for every recipient, the returned error is of type
+// *DeliveryError and is nil only if every recipient accepted the email.
+func (e *Engine) SendEmail(email *Email) ([]DeliveryResult, error) {
+	item := &QueueItem{
+		Email:   email,
+		Results: newDeliveryResults(email),
+	}
+	return item.Results, e.deliverEmail(item)
 }
 
-// Bypass the Outbound Email Queue and Send an Email Immediately
-func (e *Engine) SendEmail(email *Email) error {
+// Attempt delivery to every recipient which is still queued or deferred,
+// updating their results in place
+func (e *Engine) deliverEmail(item *QueueItem) error {
+	email, results := item.Email, item.Results
 
 	// Sanity Checks
-	if len(email.To) == 0 {
-		return fmt.Errorf("outbound email contains no recipients")
+	recipients := email.Recipients()
+	if len(recipients) == 0 {
+		return permanentError("outbound email contains no recipients")
+	}
+	if email.MessageID == "" {
+		email.MessageID = fmt.Sprint(newQueueID(), "@", e.messageIDDomain(email))
+	}
+	if err := e.validateSender(email); err != nil {
+		err := permanentError("outbound email rejected: %s", err)
+		failPendingResults(results, err)
+		return err
 	}
 
 	// Run Middleware
 	for _, mw := range e.outgoingMiddleware {
 		if proceed, err := mw(email); !proceed {
-			return fmt.Errorf("outbound email cancelled by middleware: %s", err)
+			err := permanentError("outbound email cancelled by middleware: %s", err)
+			failPendingResults(results, err)
+			return err
+		}
+	}
+
+	// Route Recipients
+	// 	Recipients handled by the transport map are dealt with immediately, everyone
+	// 	else is grouped by destination so they can share a connection and transaction
+	ctx, cancel := context.WithTimeout(context.Background(), e.OutgoingTimeout)
+	defer cancel()
+	batches := []*deliveryBatch{}
+	var shared []byte
+	for i := range results {
+		r := &results[i]
+		if r.Status != DeliveryQueued && r.Status != DeliveryDeferred {
+			continue
+		}
+		addressee := Address{Address: r.Recipient}
+		for _, a := range recipients {
+			if a.Address == r.Recipient {
+				addressee = a
+				break
+			}
+		}
+		host, err := extractHostFromAddress(addressee.Address)
+		if err != nil {
+			beginAttempt(r)
+			r.Status, r.Message = DeliveryBounced, err.Error()
+			continue
+		}
+		rule := e.OutgoingTransport.Lookup(host)
+		if e.deliverTransport(item, addressee, rule, r) {
+			continue
+		}
+		relay := e.relayFor(host)
+		if rule != nil {
+			relay = rule.Relay
+		}
+
+		// Prepare Envelope
+		// 	Every recipient receives a unique email, because sending an email to 10 people
+		// 	probably isn't the behaviour you were hoping for. Emails with Cc or Bcc recipients
+		// 	are meant to be shared so they are, and only then do recipients share a transaction.
+		// 	Separate emails are never combined into one transaction, they reuse pooled sessions.
+		envelope := shared
+		if envelope == nil {
+			sharing := len(email.Cc) > 0 || len(email.Bcc) > 0
+			to := []Address{addressee}
+			if sharing {
+				to = email.To
+			}
+			if envelope, err = e.prepareEnvelope(item, to); err != nil {
+				beginAttempt(r)
+				r.Status, r.Message = DeliveryBounced, err.Error()
+				continue
+			}
+			if sharing || item.Raw != nil {
+				shared = envelope
+			}
+		}
+
+		// Group Recipients
+		// 	Domains sharing mail exchangers (e.g. gmail.com and googlemail.com) share a batch
+		host = strings.ToLower(host)
+		key := e.destinationKey(ctx, host, relay)
+		var batch *deliveryBatch
+		for _, b := range batches {
+			if b.key == key && bytes.Equal(b.envelope, envelope) {
+				batch = b
+				break
+			}
+		}
+		if batch == nil {
+			batch = &deliveryBatch{key: key, domain: host, relay: relay, envelope: envelope}
+			batches = append(batches, batch)
+		}
+		if !slices.Contains(batch.domains, host) {
+			batch.domains = append(batch.domains, host)
+		}
+		batch.results = append(batch.results, r)
+	}
+	retryAfter := time.Duration(0)
+	throttled := map[*DeliveryResult]bool{}
+	for _, b := range batches {
+		if wait := e.deliverBatch(item, b); wait > 0 {
+			retryAfter = max(retryAfter, wait)
+			for _, r := range b.results {
+				throttled[r] = true
+			}
 		}
 	}
 
-	// Generate Unique Email for Each Recipient
-	// 	Because sending an email to 10 people probably isn't the
-	// 	behaviour you were hoping for
-	for _, addressee := range email.To {
+	// Summarize Results
+	failures := []string{}
+	permanent := true
+	for i, r := range results {
+		switch r.Status {
+		case DeliveryDelivered:
+			continue
+		case DeliveryDeferred, DeliveryQueued:
+			permanent = false
+			if !throttled[&results[i]] {
+				// Other recipients are waiting on the usual retry schedule
+				retryAfter = 0
+			}
+		}
+		failures = append(failures, fmt.Sprintf("%s (%s): %s", r.Recipient, r.Status, r.Message))
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	return &DeliveryError{
+		Permanent:  permanent,
+		RetryAfter: retryAfter,
+		Err:        fmt.Errorf("email delivery failed for %d recipient(s):\n %s", len(failures), strings.Join(failures, "\n ")),
+	}
+}
 
-		// Create New Envelope for Recipient
-		var envelope bytes.Buffer
-		builder := enmime.Builder().
-			From(email.From.Name, email.From.Address).
-			To(addressee.Name, addressee.Address).
-			Subject(email.Subject)
+// Mark every recipient that has not yet reached a final status as bounced
+func failPendingResults(results []DeliveryResult, err error) {
+	now := time.Now()
+	for i := range results {
+		r := &results[i]
+		if r.Status == DeliveryQueued || r.Status == DeliveryDeferred {
+			r.Status = DeliveryBounced
+			r.Message = err.Error()
+			r.LastAttempt = now
+		}
+	}
+}
+
+// Build the envelope of an email with the given recipients in its To header,
+// Bcc recipients are never written to the envelope
+func (e *Engine) buildMessage(email *Email, to []Address) ([]byte, error) {
+	if err := validateHeaders(email.Headers); err != nil {
+		return nil, err
+	}
 
-		// Append Content
-		if email.HTML {
-			builder = builder.HTML([]byte(email.Content))
+	// Create New Envelope for Recipients
+	var envelope bytes.Buffer
+	builder := enmime.Builder().
+		From(email.From.Name, email.From.Address).
+		Subject(email.Subject).
+		Header("Message-ID", "<"+email.MessageID+">")
+	for _, addressee := range to {
+		builder = builder.To(addressee.Name, addressee.Address)
+	}
+	for _, addressee := range email.Cc {
+		builder = builder.CC(addressee.Name, addressee.Address)
+	}
+	if email.ReplyTo != nil {
+		builder = builder.ReplyTo(email.ReplyTo.Name, email.ReplyTo.Address)
+	}
+	if email.InReplyTo != "" {
+		builder = builder.Header("In-Reply-To", "<"+email.InReplyTo+">")
+	}
+	if len(email.References) > 0 {
+		builder = builder.Header("References", "<"+strings.Join(email.References, "> <")+">")
+	}
+	for _, name := range slices.Sorted(maps.Keys(email.Headers)) {
+		builder = builder.Header(name, email.Headers[name])
+	}
+	if email.Auth != nil {
+		// Forwarded emails keep the results of the checks we performed on them
+		builder = builder.Header("Authentication-Results", email.Auth.Header(e.Domain))
+	}
+
+	// Append Content
+	// 	Emails with both bodies are sent as multipart/alternative, a plain text
+	// 	body can be generated for HTML emails so every client can read them
+	text, html := email.Bodies()
+	if text == "" && html != "" && e.OutgoingGenerateText {
+		generated, err := html2text.FromString(html, html2text.Options{})
+		if err != nil {
+			return nil, fmt.Errorf("cannot generate text body: %s", err)
+		}
+		text = generated
+	}
+	if html != "" {
+		builder = builder.HTML([]byte(html))
+	}
+	if text != "" || html == "" {
+		builder = builder.Text([]byte(text))
+	}
+
+	// Append Attachments
+	for i := range email.Attachments {
+		a := &email.Attachments[i]
+		if a.Inline {
+			builder = builder.AddInline(a.Data, a.ContentType, a.Filename, a.Filename)
 		} else {
-			builder = builder.Text([]byte(email.Content))
+			builder = builder.AddAttachment(a.Data, a.ContentType, a.Filename)
 		}
+	}
+
+	// Build Envelope
+	if p, err := builder.Build(); err != nil {
+		return nil, fmt.Errorf("cannot build outbound email: %s", err)
+	} else if err := p.Encode(&envelope); err != nil {
+		return nil, fmt.Errorf("cannot encode outbound email: %s", err)
+	}
+	return envelope.Bytes(), nil
+}
+
+// Headers which are managed by the engine and cannot be set on an email
+var reservedHeaders = map[string]bool{
+	"Authentication-Results":    true,
+	"Bcc":                       true,
+	"Cc":                        true,
+	"Content-Disposition":       true,
+	"Content-Id":                true,
+	"Content-Transfer-Encoding": true,
+	"Content-Type":              true,
+	"Date":                      true,
+	"Dkim-Signature":            true,
+	"From":                      true,
+	"In-Reply-To":               true,
+	"Message-Id":                true,
+	"Mime-Version":              true,
+	"Received":                  true,
+	"References":                true,
+	"Reply-To":                  true,
+	"Return-Path":               true,
+	"Sender":                    true,
+	"Subject":                   true,
+	"To":                        true,
+}
 
-		// Append Attachments
-		for i := range email.Attachments {
-			a := &email.Attachments[i]
-			if a.Inline {
-				builder = builder.AddInline(a.Data, a.ContentType, a.Filename, a.Filename)
-			} else {
-				builder = builder.AddAttachment(a.Data, a.ContentType, a.Filename)
+// Ensure custom headers are well formed and do not override reserved headers
+func validateHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		if name == "" {
+			return fmt.Errorf("header name cannot be empty")
+		}
+		for _, c := range name {
+			// Printable US-ASCII except colon (RFC 5322 section 3.6.8)
+			if c < 33 || c > 126 || c == ':' {
+				return fmt.Errorf("header name is invalid: %q", name)
 			}
 		}
+		if reservedHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+			return fmt.Errorf("header is reserved: %s", name)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return fmt.Errorf("header value for %s contains invalid characters", name)
+		}
+	}
+	return nil
+}
 
-		// Build Envelope
-		if p, err := builder.Build(); err != nil {
-			return fmt.Errorf("cannot build outbound email: %s", err)
-		} else if err := p.Encode(&envelope); err != nil {
-			return fmt.Errorf("cannot encode outbound email: %s", err)
+// Build and sign the envelope of an email for the given recipients,
+// notifications generated by the engine are prerendered
+func (e *Engine) prepareEnvelope(item *QueueItem, addressees []Address) ([]byte, error) {
+	envelope := item.Raw
+	if envelope == nil {
+		var err error
+		if envelope, err = e.buildMessage(item.Email, addressees); err != nil {
+			return nil, err
 		}
+	}
+	return e.signEnvelope(envelope, domainOf(item.Email.From.Address))
+}
+
+// Recipients of an email which share a destination and envelope
+type deliveryBatch struct {
+	key      string   // Destination shared by every recipient, see destinationKey
+	domain   string   // Domain used to lookup the mail exchangers of the destination
+	domains  []string // Recipient domains in the batch, each is rate limited
+	relay    *Relay
+	envelope []byte
+	results  []*DeliveryResult
+}
+
+// Identify where the recipients of a domain are delivered to, either a relay or
+// the set of mail exchangers of the domain. Domains which cannot be resolved
+// are kept apart so the error is recorded by deliverBatch.
+func (e *Engine) destinationKey(ctx context.Context, domain string, relay *Relay) string {
+	if relay != nil {
+		return fmt.Sprintf("relay %p", relay)
+	}
+	records, err := e.lookupExchangers(ctx, domain)
+	if err != nil {
+		return "domain " + domain
+	}
+	hosts := make([]string, len(records))
+	for i, record := range records {
+		hosts[i] = strings.ToLower(strings.TrimSuffix(record.Host, "."))
+	}
+	return "mx " + strings.Join(hosts, " ")
+}
+
+// Record the start of a delivery attempt
+func beginAttempt(r *DeliveryResult) {
+	r.Attempts++
+	r.LastAttempt = time.Now()
+	if r.FirstAttempt.IsZero() {
+		r.FirstAttempt = r.LastAttempt
+	}
+}
 
-		// Sign Envelope
-		var complete bytes.Buffer
-		if e.outgoingDKIMSigner != nil {
-			// Sign Email using DKIM Key
-			if err := dkim.Sign(&complete, &envelope, &dkim.SignOptions{
-				Domain:   e.Domain,
-				Signer:   e.outgoingDKIMSigner,
-				Selector: e.OutgoingSelectorName,
-			}); err != nil {
-				return fmt.Errorf("cannot sign outbound email: %s", err)
+// Attempt to deliver an envelope to a batch of recipients in a single
+// transaction, recording the outcome for each of them. If the recipient
+// domain is throttled the batch is deferred and the delay is returned.
+func (e *Engine) deliverBatch(item *QueueItem, b *deliveryBatch) time.Duration {
+	for i, domain := range b.domains {
+		wait, ok := e.acquireDomain(domain)
+		if !ok {
+			for _, acquired := range b.domains[:i] {
+				e.cancelDomain(acquired)
 			}
-		} else {
-			// inb4 marked as spam or rejected
-			complete = envelope
+			for _, r := range b.results {
+				r.Status, r.Code, r.EnhancedCode = DeliveryDeferred, 0, ""
+				r.Message = fmt.Sprintf("delivery to '%s' throttled by rate limit", domain)
+			}
+			return wait
+		}
+	}
+	defer func() {
+		for _, domain := range b.domains {
+			results := []*DeliveryResult{}
+			for _, r := range b.results {
+				if domainOf(r.Recipient) == domain {
+					results = append(results, r)
+				}
+			}
+			e.releaseDomain(domain, results)
 		}
+	}()
+	for _, r := range b.results {
+		beginAttempt(r)
+	}
 
-		// Lookup MX Records for Provided Addressee
-		host, err := extractHostFromAddress(addressee.Address)
+	// Bounces are sent with a null reverse-path so they can never bounce back
+	sender := item.Email.From.Address
+	if item.Bounce {
+		sender = ""
+	}
+
+	// Resolve Destinations
+	// 	A relay takes over responsibility for reaching the recipient once it has
+	// 	accepted the envelope, otherwise we lookup the MX Records for the domain
+	ctx, cancel := context.WithTimeout(context.Background(), e.OutgoingTimeout)
+	defer cancel()
+	destinations := []sessionDestination{}
+	if b.relay != nil {
+		destinations = append(destinations, sessionDestination{
+			host: b.relay.Host,
+			key:  fmt.Sprint("relay ", b.relay.Host, " ", b.relay.Port, " ", b.relay.Username),
+			dial: func(ctx context.Context) (*outgoingSession, error) { return e.dialRelay(ctx, b.relay) },
+		})
+	} else {
+		records, err := e.lookupExchangers(ctx, b.domain)
 		if err != nil {
-			return err
+			de := err.(*DeliveryError)
+			for _, r := range b.results {
+				r.Status = DeliveryDeferred
+				if de.Permanent {
+					r.Status = DeliveryBounced
+				}
+				r.Code, r.EnhancedCode, r.Message = de.Code, de.EnhancedCode, err.Error()
+			}
+			return 0
+		}
+		for _, record := range records {
+			host := record.Host
+			destinations = append(destinations, sessionDestination{
+				host: host,
+				key:  "mx " + strings.ToLower(host),
+				dial: func(ctx context.Context) (*outgoingSession, error) { return e.dialSession(ctx, host) },
+			})
 		}
-		records, err := net.LookupMX(host)
+	}
+
+	// Attempt to Deliver Envelope
+	// 	We try each available server in order of preference, a permanent rejection
+	// 	from any of them is final while anything else moves on to the next server
+	pending := b.results
+	for _, d := range destinations {
+		for _, r := range pending {
+			r.Host = d.host
+		}
+		session, err := e.acquireSession(ctx, d)
 		if err != nil {
-			if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
-				return fmt.Errorf("no mx records for outbound host '%s'", host)
-			} else {
-				return fmt.Errorf("cannot lookup mx records for outbound host '%s': %s", host, err)
+			for _, r := range pending {
+				applyReply(r, err)
+				r.Status = DeliveryDeferred
 			}
+			continue
 		}
-		sort.Slice(records, func(i, j int) bool {
-			// These should already be sorted, but we sort them ourselves jic
-			return records[i].Pref < records[j].Pref
-		})
-
-		// Attempt to Deliver Envelope
-		//	The smtp.SendEmail function has an internal timeout of 10 seconds (lame)
-		// 	We additionally want to cycle through as many available servers as possible
-		attemptErrors := []string{}
-		attemptTotal := max(int(e.OutgoingTimeout.Seconds()/10), 1)
-		for i := 0; i < attemptTotal; i++ {
-			host := records[i%len(records)].Host
-			if err := smtp.SendMail(
-				fmt.Sprint(host, ":", 25),
-				nil, // anonymous
-				email.From.Address,
-				[]string{addressee.Address},
-				complete.Bytes(),
-			); err != nil {
-				message := fmt.Sprintf("attempt %d/%d failed: %s", i+1, attemptTotal, err.Error())
-				attemptErrors = append(attemptErrors, message)
-				continue
+		recipients := make([]string, len(pending))
+		for i, r := range pending {
+			recipients[i] = r.Recipient
+		}
+		reply, rcptErrors, err := session.send(ctx, sender, recipients, b.envelope)
+		if err == nil {
+			e.releaseSession(d, session)
+		} else {
+			session.close()
+		}
+		remaining := []*DeliveryResult{}
+		for i, r := range pending {
+			rcptErr := rcptErrors[i]
+			if rcptErr == nil {
+				rcptErr = err
+			}
+			switch {
+			case rcptErr == nil:
+				r.Status = DeliveryDelivered
+				r.Code = 250
+				r.EnhancedCode, r.Message = splitEnhancedCode(reply)
+			case applyReply(r, rcptErr):
+				r.Status = DeliveryBounced
+			default:
+				r.Status = DeliveryDeferred
+				remaining = append(remaining, r)
 			}
-			return nil
 		}
-		return fmt.Errorf("email delivery failed:\n %s", strings.Join(attemptErrors, "\n"))
+		if pending = remaining; len(pending) == 0 {
+			return 0
+		}
 	}
-	return nil
+	return 0
 }
 
 // Extracts the Host from an Email Address (e.g. bakonpancakz@gmail.com => gmail.com)
@@ -145,3 +568,29 @@ func extractHostFromAddress(address string) (string, error) {
 	}
 	return parts[1], nil
 }
+
+// Remove an email waiting in the Outgoing Queue, such as one scheduled for later
+// or waiting for a retry. Returns false if no such email is waiting, which is
+// also the case while it is being sent.
+func (e *Engine) CancelEmail(id string) bool {
+	item := e.outgoingQueue.remove(id)
+	if item == nil {
+		return false
+	}
+	now := time.Now()
+	for i := range item.Results {
+		r := &item.Results[i]
+		if r.Status == DeliveryQueued || r.Status == DeliveryDeferred {
+			r.Status = DeliveryCancelled
+			r.Message = "Cancelled before delivery"
+			r.LastAttempt = now
+		}
+	}
+	e.updateStatus(item, "")
+	if e.OutgoingQueueStore != nil {
+		if err := e.OutgoingQueueStore.Done(id); err != nil {
+			e.ErrorLogger(fmt.Errorf("cannot mark cancelled email as done: %s", err))
+		}
+	}
+	return true
+}
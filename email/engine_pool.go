@@ -0,0 +1,125 @@
+package email
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A server which outgoing emails can be delivered to
+type sessionDestination struct {
+	host string                                              // Hostname reported in Delivery Results
+	key  string                                              // Identifies interchangeable sessions in the pool
+	dial func(ctx context.Context) (*outgoingSession, error) // Opens a new session
+}
+
+// Idle SMTP sessions kept open for reuse, grouped by destination
+type sessionPool struct {
+	mu   sync.Mutex
+	idle map[string][]idleSession
+}
+
+type idleSession struct {
+	session *outgoingSession
+	since   time.Time
+}
+
+func newSessionPool() *sessionPool {
+	return &sessionPool{idle: make(map[string][]idleSession)}
+}
+
+// Take the most recently used session for a destination which has not been
+// idle for longer than the given duration, returns nil if there are none
+func (p *sessionPool) get(key string, timeout time.Duration) *outgoingSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sessions := p.idle[key]
+	for len(sessions) > 0 {
+		last := sessions[len(sessions)-1]
+		sessions = sessions[:len(sessions)-1]
+		if time.Since(last.since) <= timeout {
+			p.idle[key] = sessions
+			return last.session
+		}
+		// Skip the goodbye since the server has likely dropped us already
+		last.session.client.Close()
+	}
+	delete(p.idle, key)
+	return nil
+}
+
+// Return a session to the pool, it is closed instead if the destination
+// already has the given number of idle sessions
+func (p *sessionPool) put(key string, s *outgoingSession, size int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[key]) >= size {
+		return false
+	}
+	p.idle[key] = append(p.idle[key], idleSession{session: s, since: time.Now()})
+	return true
+}
+
+// Close every session which has been idle for longer than the given duration
+func (p *sessionPool) prune(timeout time.Duration) {
+	expired := []*outgoingSession{}
+	p.mu.Lock()
+	for key, sessions := range p.idle {
+		active := sessions[:0]
+		for _, s := range sessions {
+			if time.Since(s.since) > timeout {
+				expired = append(expired, s.session)
+			} else {
+				active = append(active, s)
+			}
+		}
+		if len(active) == 0 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = active
+		}
+	}
+	p.mu.Unlock()
+
+	// Sessions are closed outside of the lock as saying goodbye may take a while
+	for _, s := range expired {
+		s.close()
+	}
+}
+
+// Close every idle session
+func (p *sessionPool) close() {
+	p.prune(-1)
+}
+
+// Reuse an idle session for the destination or open a new one. Idle sessions
+// are reset before they are handed out which also ensures they are still alive.
+func (e *Engine) acquireSession(ctx context.Context, d sessionDestination) (*outgoingSession, error) {
+	for {
+		s := e.outgoingPool.get(d.key, e.OutgoingPoolTimeout)
+		if s == nil {
+			break
+		}
+		if err := s.client.Reset(); err == nil {
+			if deadline, ok := ctx.Deadline(); ok {
+				s.conn.SetDeadline(deadline)
+			}
+			return s, nil
+		}
+		s.client.Close()
+	}
+	return d.dial(ctx)
+}
+
+// Return a session after a completed transaction so it can be reused
+func (e *Engine) releaseSession(d sessionDestination, s *outgoingSession) {
+	if e.OutgoingPoolSize <= 0 || !e.outgoingPool.put(d.key, s, e.OutgoingPoolSize) {
+		s.close()
+		return
+	}
+	// Idle sessions are closed once they expire rather than waiting
+	// for the server to drop them at a time of its choosing
+	time.AfterFunc(e.OutgoingPoolTimeout, func() {
+		e.outgoingPool.prune(e.OutgoingPoolTimeout)
+	})
+}
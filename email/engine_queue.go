@@ -0,0 +1,488 @@
+package email
+
+import (
+	"bufio"
+	"container/heap"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Persistent Storage for the Outgoing Queue.
+// Implementations must have durably stored an item before Put returns.
+type QueueStore interface {
+	Put(item *QueueItem) error      // Persist a new or updated item
+	Done(id string) error           // Remove an item once it no longer needs to be sent
+	Pending() ([]*QueueItem, error) // List all items which have not been marked as done
+	Close() error                   // Flush and release any held resources
+}
+
+// An Email accepted into the Outgoing Queue
+type QueueItem struct {
+	ID          string           `json:"id"`
+	Email       *Email           `json:"email"`
+	QueuedAt    time.Time        `json:"queued_at"`
+	NextAttempt time.Time        `json:"next_attempt"`
+	Attempts    int              `json:"attempts"`
+	Results     []DeliveryResult `json:"results"`
+	Raw         []byte           `json:"raw,omitempty"`          // Prerendered envelope used instead of building from Email
+	Bounce      bool             `json:"bounce,omitempty"`       // Email is a delivery status notification sent with a null sender
+	DelayNotice int              `json:"delay_notice,omitempty"` // Amount of delayed delivery notifications already sent
+	Auth        *AuthResults     `json:"auth,omitempty"`         // Authentication Results of a forwarded Email, which are not part of its JSON
+}
+
+// Returns the time from which the age of an item is measured,
+// scheduled emails only start aging once they are due
+func (item *QueueItem) since() time.Time {
+	if item.Email.SendAt.After(item.QueuedAt) {
+		return item.Email.SendAt
+	}
+	return item.QueuedAt
+}
+
+// Generates a random identifier for queued items
+func newQueueID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Opens the Queue Store, replaying any unsent emails into the Outgoing Queue.
+// This happens once, whichever of QueueEmail or StartSMTP is called first.
+func (e *Engine) openQueueStore() (QueueStore, error) {
+	e.outgoingStoreOnce.Do(func() {
+		if e.OutgoingQueueStore == nil {
+			store, err := OpenFileQueue(e.OutgoingQueuePath)
+			if err != nil {
+				e.outgoingStoreErr = fmt.Errorf("cannot open outgoing queue: %s", err)
+				return
+			}
+			e.OutgoingQueueStore = store
+		}
+		pending, err := e.OutgoingQueueStore.Pending()
+		if err != nil {
+			e.outgoingStoreErr = fmt.Errorf("cannot replay outgoing queue: %s", err)
+			return
+		}
+		for _, item := range pending {
+			item.Email.Auth = item.Auth
+			e.updateStatus(item, "")
+			e.outgoingQueue.push(item)
+		}
+	})
+	return e.OutgoingQueueStore, e.outgoingStoreErr
+}
+
+// Processes Queued Emails as they become due.
+// Recipients with transient failures are written back to the Queue Store and
+// rescheduled with an exponential backoff, the email is dropped from the queue
+// once every recipient has either been delivered or bounced.
+func (e *Engine) outgoingWorker(store QueueStore) {
+	defer e.activeWorkers.Done()
+	for {
+		item, ok := e.outgoingQueue.pop()
+		if !ok {
+			return
+		}
+		if item.Results == nil {
+			item.Results = newDeliveryResults(item.Email)
+		}
+		item.Attempts++
+		e.updateStatus(item, DeliverySending)
+		previous := make([]DeliveryStatus, len(item.Results))
+		for i := range item.Results {
+			previous[i] = item.Results[i].Status
+		}
+		err := e.deliverEmail(item)
+
+		// Reschedule Deferred Recipients
+		var de *DeliveryError
+		if err != nil && errors.As(err, &de) && !de.Permanent {
+			if time.Since(item.since()) < e.OutgoingMaxQueueAge {
+				if de.RetryAfter > 0 && !progressed(item.Results, previous) {
+					// Throttled emails were never attempted, so they wait in memory
+					// until the rate limit allows them without counting as an attempt
+					item.Attempts--
+					item.NextAttempt = time.Now().Add(de.RetryAfter)
+					e.updateStatus(item, "")
+					e.outgoingQueue.push(item)
+					continue
+				}
+				item.NextAttempt = time.Now().Add(e.retryDelay(item.Attempts))
+				if de.RetryAfter > 0 {
+					// The remaining recipients were throttled so they keep their place in the schedule
+					item.NextAttempt = time.Now().Add(de.RetryAfter)
+				}
+				if err := store.Put(item); err != nil {
+					e.ErrorLogger(fmt.Errorf("cannot reschedule queued email: %s", err))
+				}
+				e.notifyBounced(item, previous)
+				e.notifyDelayed(item)
+				e.updateStatus(item, "")
+				e.outgoingQueue.push(item)
+				if de.RetryAfter == 0 {
+					// Throttling is flow control rather than an error, the Delivery Handler still sees it
+					e.ErrorLogger(fmt.Errorf("outbound email deferred (attempt %d): %s", item.Attempts, err))
+				}
+				if e.DeliveryHandler != nil {
+					e.DeliveryHandler(item.Email, item.Results)
+				}
+				continue
+			}
+			err = fmt.Errorf("outbound email expired after %d attempts: %s", item.Attempts, err)
+			failPendingResults(item.Results, err)
+		}
+		e.notifyBounced(item, previous)
+		e.updateStatus(item, "")
+		if err != nil {
+			e.ErrorLogger(err)
+		}
+		if e.DeliveryHandler != nil {
+			e.DeliveryHandler(item.Email, item.Results)
+		}
+		if err := store.Done(item.ID); err != nil {
+			e.ErrorLogger(fmt.Errorf("cannot mark queued email as done: %s", err))
+		}
+	}
+}
+
+// Reports whether any recipient was delivered or bounced since the previous statuses
+func progressed(results []DeliveryResult, previous []DeliveryStatus) bool {
+	for i, r := range results {
+		if r.Status != previous[i] && r.Status != DeliveryDeferred {
+			return true
+		}
+	}
+	return false
+}
+
+// Calculate the delay before the next attempt, doubling from OutgoingRetryInterval
+// up to OutgoingRetryMaximum with jitter so deferred emails don't retry in lockstep
+func (e *Engine) retryDelay(attempts int) time.Duration {
+	delay := max(e.OutgoingRetryInterval, time.Second)
+	for i := 1; i < attempts && delay < e.OutgoingRetryMaximum; i++ {
+		delay *= 2
+	}
+	delay = min(delay, max(e.OutgoingRetryMaximum, time.Second))
+	return delay/2 + mathrand.N(delay/2+1)
+}
+
+// In-Memory Queue of Emails ordered by their next attempt time
+type outgoingQueue struct {
+	mu     sync.Mutex
+	items  outgoingHeap
+	wake   chan struct{} // Closed and replaced whenever the queue changes
+	closed bool
+}
+
+func newOutgoingQueue() *outgoingQueue {
+	return &outgoingQueue{wake: make(chan struct{})}
+}
+
+func (q *outgoingQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Removes a waiting item from the queue, returns nil if it is not waiting
+func (q *outgoingQueue) remove(id string) *QueueItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, item := range q.items {
+		if item.ID == id {
+			heap.Remove(&q.items, i)
+			q.notify()
+			return item
+		}
+	}
+	return nil
+}
+
+func (q *outgoingQueue) push(item *QueueItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	heap.Push(&q.items, item)
+	q.notify()
+}
+
+// Blocks until an item is due, returns false once the queue is closed
+func (q *outgoingQueue) pop() (*QueueItem, bool) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return nil, false
+		}
+		wake := q.wake
+		if len(q.items) == 0 {
+			q.mu.Unlock()
+			<-wake
+			continue
+		}
+		wait := time.Until(q.items[0].NextAttempt)
+		if wait <= 0 {
+			item := heap.Pop(&q.items).(*QueueItem)
+			q.mu.Unlock()
+			return item, true
+		}
+		q.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Wakes all waiting workers, any remaining items are left in the Queue Store
+func (q *outgoingQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.notify()
+}
+
+func (q *outgoingQueue) notify() {
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
+
+type outgoingHeap []*QueueItem
+
+func (h outgoingHeap) Len() int           { return len(h) }
+func (h outgoingHeap) Less(i, j int) bool { return h[i].NextAttempt.Before(h[j].NextAttempt) }
+func (h outgoingHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *outgoingHeap) Push(x any)        { *h = append(*h, x.(*QueueItem)) }
+func (h *outgoingHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// A Queue Store backed by an append-only log file.
+// Every change is written and synced to disk before returning, the log is
+// compacted once enough completed items have accumulated.
+type FileQueue struct {
+	mu      sync.Mutex
+	path    string
+	file    queueFile
+	pending map[string][]byte // Latest put record of each item, as written to the log
+	done    int
+}
+
+// The open log file, replaced in tests to simulate failing writes
+type queueFile interface {
+	io.WriteCloser
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+type fileQueueRecord struct {
+	Op   string     `json:"op"`
+	ID   string     `json:"id,omitempty"`
+	Item *QueueItem `json:"item,omitempty"`
+}
+
+const (
+	fileQueueOpPut     = "put"
+	fileQueueOpDone    = "done"
+	fileQueueCompactAt = 1024 // Compact after this many completed items
+)
+
+// Open or create a file-backed Queue Store at the given path
+func OpenFileQueue(path string) (*FileQueue, error) {
+	q := &FileQueue{
+		path:    path,
+		pending: make(map[string][]byte),
+	}
+
+	// Replay Existing Log
+	// 	A crash during a write can leave a torn record in the log, since it was
+	// 	never acknowledged we can safely skip it and keep reading the records after it
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64<<10), 1<<30)
+		for scanner.Scan() {
+			var record fileQueueRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				continue
+			}
+			switch record.Op {
+			case fileQueueOpPut:
+				if record.Item != nil {
+					q.pending[record.Item.ID] = slices.Clone(scanner.Bytes())
+				}
+			case fileQueueOpDone:
+				delete(q.pending, record.ID)
+				q.done++
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Rewrite Log without Completed or Torn Records
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Items are marshalled before returning, workers may keep changing them while
+// the log is compacted without affecting what was stored
+func (q *FileQueue) Put(item *QueueItem) error {
+	b, err := json.Marshal(fileQueueRecord{Op: fileQueueOpPut, Item: item})
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.append(b); err != nil {
+		return err
+	}
+	q.pending[item.ID] = b
+	return nil
+}
+
+func (q *FileQueue) Done(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.pending[id]; !ok {
+		return nil
+	}
+	b, err := json.Marshal(fileQueueRecord{Op: fileQueueOpDone, ID: id})
+	if err != nil {
+		return err
+	}
+	if err := q.append(b); err != nil {
+		return err
+	}
+	delete(q.pending, id)
+	q.done++
+	if q.done >= fileQueueCompactAt {
+		return q.compact()
+	}
+	return nil
+}
+
+func (q *FileQueue) Pending() ([]*QueueItem, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := make([]*QueueItem, 0, len(q.pending))
+	for _, b := range q.pending {
+		var record fileQueueRecord
+		if err := json.Unmarshal(b, &record); err != nil {
+			return nil, err
+		}
+		items = append(items, record.Item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].QueuedAt.Before(items[j].QueuedAt)
+	})
+	return items, nil
+}
+
+func (q *FileQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == nil {
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
+
+func (q *FileQueue) append(b []byte) error {
+	if q.file == nil {
+		return fmt.Errorf("queue file is closed")
+	}
+	info, err := q.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Remove Torn Writes
+	// 	Otherwise the next record would be appended to the same line and lost on replay,
+	// 	if we can't remove it the queue is closed rather than risk losing more emails
+	_, err = q.file.Write(append(b, '\n'))
+	if err == nil {
+		err = q.file.Sync()
+	}
+	if err != nil {
+		if terr := q.file.Truncate(info.Size()); terr != nil {
+			q.file.Close()
+			q.file = nil
+			return fmt.Errorf("%s, queue file closed as it cannot be truncated: %s", err, terr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Atomically replace the log with one containing only pending items
+func (q *FileQueue) compact() error {
+	temp := q.path + ".tmp"
+	f, err := os.OpenFile(temp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, b := range q.pending {
+		w.Write(b)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if q.file != nil {
+		q.file.Close()
+		q.file = nil
+	}
+	if err := os.Rename(temp, q.path); err != nil {
+		return err
+	}
+	q.file, err = os.OpenFile(q.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	q.done = 0
+	return syncDir(filepath.Dir(q.path))
+}
+
+// Sync a directory so a rename within it survives a crash
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
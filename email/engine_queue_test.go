@@ -0,0 +1,272 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestQueueItem(id string, queuedAt time.Time) *QueueItem {
+	return &QueueItem{
+		ID:       id,
+		QueuedAt: queuedAt,
+		Email: &Email{
+			From:    Address{Address: "sender@example.com"},
+			To:      []Address{{Address: "recipient@example.net"}},
+			Subject: "Queued " + id,
+		},
+	}
+}
+
+func openTestQueue(t *testing.T, path string) *FileQueue {
+	t.Helper()
+	q, err := OpenFileQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+// Returns the IDs of the pending items in the order they were queued
+func pendingIDs(t *testing.T, q *FileQueue) []string {
+	t.Helper()
+	items, err := q.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	return ids
+}
+
+func TestFileQueueReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outgoing.wal")
+	now := time.Now()
+
+	q := openTestQueue(t, path)
+	for i, id := range []string{"a", "b", "c"} {
+		if err := q.Put(newTestQueueItem(id, now.Add(time.Duration(i)*time.Second))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	updated := newTestQueueItem("b", now.Add(time.Second))
+	updated.Attempts = 2
+	if err := q.Put(updated); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Done("a"); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	// Restart
+	q = openTestQueue(t, path)
+	if ids := pendingIDs(t, q); !slices.Equal(ids, []string{"b", "c"}) {
+		t.Fatalf("got pending %v, want [b c]", ids)
+	}
+	items, _ := q.Pending()
+	if items[0].Attempts != 2 || items[0].Email.Subject != "Queued b" {
+		t.Errorf("replayed item was not the latest version: %+v", items[0])
+	}
+}
+
+func TestFileQueueTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outgoing.wal")
+	now := time.Now()
+
+	q := openTestQueue(t, path)
+	q.Put(newTestQueueItem("a", now))
+	q.Put(newTestQueueItem("b", now.Add(time.Second)))
+	q.Close()
+
+	// A crash during a write leaves part of a record at the end of the log
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"put","item":{"id":"c","ema`)
+	f.Close()
+
+	q = openTestQueue(t, path)
+	if ids := pendingIDs(t, q); !slices.Equal(ids, []string{"a", "b"}) {
+		t.Fatalf("got pending %v, want [a b]", ids)
+	}
+	if err := q.Put(newTestQueueItem("d", now.Add(2*time.Second))); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	q = openTestQueue(t, path)
+	if ids := pendingIDs(t, q); !slices.Equal(ids, []string{"a", "b", "d"}) {
+		t.Fatalf("got pending %v after append, want [a b d]", ids)
+	}
+}
+
+// A log file which only writes half of each record before failing
+type tornQueueFile struct {
+	*os.File
+}
+
+func (f *tornQueueFile) Write(b []byte) (int, error) {
+	n, _ := f.File.Write(b[:len(b)/2])
+	return n, errors.New("no space left on device")
+}
+
+func TestFileQueueTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outgoing.wal")
+	now := time.Now()
+
+	q := openTestQueue(t, path)
+	q.Put(newTestQueueItem("a", now))
+	before, _ := os.ReadFile(path)
+
+	file := q.file.(*os.File)
+	q.file = &tornQueueFile{file}
+	if err := q.Put(newTestQueueItem("b", now.Add(time.Second))); err == nil {
+		t.Fatal("expected the torn write to fail")
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Fatalf("torn record was not truncated: %q", after)
+	}
+
+	// Records after a failed write are still readable
+	q.file = file
+	if err := q.Put(newTestQueueItem("c", now.Add(2*time.Second))); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	q = openTestQueue(t, path)
+	if ids := pendingIDs(t, q); !slices.Equal(ids, []string{"a", "c"}) {
+		t.Fatalf("got pending %v, want [a c]", ids)
+	}
+}
+
+func TestFileQueueSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outgoing.wal")
+	q := openTestQueue(t, path)
+	item := newTestQueueItem("a", time.Now())
+	if err := q.Put(item); err != nil {
+		t.Fatal(err)
+	}
+
+	// Workers keep changing items after they were stored
+	item.Attempts = 5
+	item.Email.Subject = "Changed"
+	q.mu.Lock()
+	err := q.compact()
+	q.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	q = openTestQueue(t, path)
+	items, _ := q.Pending()
+	if len(items) != 1 || items[0].Attempts != 0 || items[0].Email.Subject != "Queued a" {
+		t.Fatalf("compacted log did not contain the stored item: %+v", items)
+	}
+}
+
+func TestFileQueueCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outgoing.wal")
+	now := time.Now()
+	q := openTestQueue(t, path)
+	q.Put(newTestQueueItem("kept", now))
+	for i := 0; i < fileQueueCompactAt; i++ {
+		id := newQueueID()
+		if err := q.Put(newTestQueueItem(id, now)); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Done(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The log is rewritten with only the pending item
+	if q.done != 0 {
+		t.Errorf("got %d completed items after compaction, want 0", q.done)
+	}
+	log, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(log, []byte("\n")); lines != 1 {
+		t.Errorf("got %d records after compaction, want 1", lines)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary log was left behind: %v", err)
+	}
+
+	// Appends continue on the compacted log
+	q.Put(newTestQueueItem("after", now.Add(time.Second)))
+	q.Close()
+	q = openTestQueue(t, path)
+	if ids := pendingIDs(t, q); !slices.Equal(ids, []string{"kept", "after"}) {
+		t.Fatalf("got pending %v, want [kept after]", ids)
+	}
+}
+
+func TestFileQueueBodies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outgoing.wal")
+	q := openTestQueue(t, path)
+	item := newTestQueueItem("a", time.Now())
+	item.Email.Content = "<p>Legacy</p>"
+	item.Email.HTML = true
+	item.Email.HTMLBody = "<p>Hello</p>"
+	item.Email.Text = "Hello"
+	if err := q.Put(item); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	// Every body survives a restart, including whether the legacy content is HTML
+	q = openTestQueue(t, path)
+	items, _ := q.Pending()
+	if len(items) != 1 {
+		t.Fatalf("got %d pending items, want 1", len(items))
+	}
+	email := items[0].Email
+	if !email.HTML || email.Content != "<p>Legacy</p>" || email.HTMLBody != "<p>Hello</p>" || email.Text != "Hello" {
+		t.Errorf("bodies were not replayed: %+v", email)
+	}
+}
+
+func TestQueueReplayAuthResults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outgoing.wal")
+	e := New("example.com")
+	e.OutgoingQueuePath = path
+	email := &Email{
+		From:    Address{Name: "Alice", Address: "alice@example.com"},
+		To:      []Address{{Name: "Bob", Address: "bob@example.net"}},
+		Subject: "Forwarded",
+		Content: "Hello World!",
+		Auth:    &AuthResults{SPF: &SPFCheck{Result: SPFPass, Identity: "mailfrom", Domain: "example.org"}},
+	}
+	if !e.QueueEmail(email) {
+		t.Fatal("email was not queued")
+	}
+	e.OutgoingQueueStore.Close()
+
+	// Restart
+	e = New("example.com")
+	e.OutgoingQueuePath = path
+	if _, err := e.openQueueStore(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.OutgoingQueueStore.Close() })
+	item := e.outgoingQueue.remove(email.ID)
+	if item == nil {
+		t.Fatal("email was not replayed")
+	}
+	if item.Email.Auth == nil || item.Email.Auth.SPF == nil || item.Email.Auth.SPF.Domain != "example.org" {
+		t.Errorf("authentication results were lost: %+v", item.Email.Auth)
+	}
+}
@@ -0,0 +1,157 @@
+package email
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits how hard outgoing emails hit a recipient domain, recipients which
+// exceed a limit are deferred until the domain is ready to receive more email
+type RateLimit struct {
+	MessagesPerMinute int  // Maximum transactions started per minute, 0 for unlimited
+	Connections       int  // Maximum concurrent deliveries, 0 for unlimited
+	Adaptive          bool // Back off exponentially while the domain replies with 421 or 451
+}
+
+// Delay before retrying recipients throttled by a connection limit
+const throttleDelay = 5 * time.Second
+
+// Rate limiting state for each recipient domain
+type rateLimiter struct {
+	mu      sync.Mutex
+	domains map[string]*domainState
+	pruned  time.Time
+}
+
+type domainState struct {
+	tokens  float64       // Transactions which may be started right now
+	updated time.Time     // Last time tokens were replenished
+	active  int           // Deliveries in progress
+	factor  float64       // Multiplier applied to the rate when backing off
+	backoff time.Duration // Current pause applied after a throttling reply
+	paused  time.Time     // Deliveries are deferred until then
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{domains: make(map[string]*domainState), pruned: time.Now()}
+}
+
+// Returns the Rate Limit for a recipient domain
+func (e *Engine) rateLimitFor(domain string) RateLimit {
+	if limit, ok := e.OutgoingRateLimits[domain]; ok {
+		return limit
+	}
+	return e.OutgoingRateLimit
+}
+
+// Reserve a delivery to the given domain, returning how long to wait
+// before trying again if the domain is currently throttled
+func (e *Engine) acquireDomain(domain string) (time.Duration, bool) {
+	domain = strings.ToLower(domain)
+	limit := e.rateLimitFor(domain)
+	l := e.outgoingLimiter
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now)
+	s, ok := l.domains[domain]
+	if !ok {
+		s = &domainState{tokens: float64(limit.MessagesPerMinute), updated: now, factor: 1}
+		l.domains[domain] = s
+	}
+
+	// Adaptive Backoff
+	if now.Before(s.paused) {
+		return s.paused.Sub(now), false
+	}
+
+	// Concurrent Deliveries
+	if limit.Connections > 0 && s.active >= limit.Connections {
+		return throttleDelay, false
+	}
+
+	// Messages per Minute
+	// 	Tokens are replenished continuously up to a burst of one minute's worth
+	if limit.MessagesPerMinute > 0 {
+		rate := float64(limit.MessagesPerMinute) * s.factor / float64(time.Minute)
+		s.tokens = min(s.tokens+rate*float64(now.Sub(s.updated)), float64(limit.MessagesPerMinute))
+		s.updated = now
+		if s.tokens < 1 {
+			return time.Duration((1 - s.tokens) / rate), false
+		}
+		s.tokens--
+	}
+	s.active++
+	s.updated = now
+	return 0, true
+}
+
+// Cancel a delivery reserved by acquireDomain which was never attempted
+func (e *Engine) cancelDomain(domain string) {
+	domain = strings.ToLower(domain)
+	limit := e.rateLimitFor(domain)
+	l := e.outgoingLimiter
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.domains[domain]
+	if !ok {
+		return
+	}
+	s.active--
+	if limit.MessagesPerMinute > 0 {
+		s.tokens = min(s.tokens+1, float64(limit.MessagesPerMinute))
+	}
+}
+
+// Release a delivery reserved by acquireDomain, adjusting the adaptive
+// backoff according to the replies received by the recipients
+func (e *Engine) releaseDomain(domain string, results []*DeliveryResult) {
+	domain = strings.ToLower(domain)
+	limit := e.rateLimitFor(domain)
+	l := e.outgoingLimiter
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.domains[domain]
+	if !ok {
+		return
+	}
+	s.active--
+	if !limit.Adaptive {
+		return
+	}
+
+	throttled := false
+	for _, r := range results {
+		if r.Code == 421 || r.Code == 451 {
+			throttled = true
+		}
+	}
+	if throttled {
+		// Slow down and pause for increasingly longer periods
+		s.factor = max(s.factor/2, 1.0/64)
+		s.backoff = min(max(s.backoff*2, e.OutgoingRetryInterval), e.OutgoingRetryMaximum)
+		s.paused = time.Now().Add(s.backoff)
+	} else {
+		// Gradually recover once the domain accepts our emails again
+		s.factor = min(s.factor*2, 1)
+		s.backoff = 0
+	}
+}
+
+// Discard state for domains which have been left alone for a while
+func (l *rateLimiter) prune(now time.Time) {
+	// We only need to do this occasionally so we don't scan on every delivery
+	if now.Sub(l.pruned) < time.Hour {
+		return
+	}
+	for domain, s := range l.domains {
+		if s.active == 0 && s.factor == 1 && now.Sub(s.updated) > time.Hour && now.After(s.paused) {
+			delete(l.domains, domain)
+		}
+	}
+	l.pruned = now
+}
@@ -0,0 +1,97 @@
+package email
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// A Queue Store which only counts how often it was written to
+type countingQueueStore struct {
+	mu   sync.Mutex
+	puts int
+	done int
+}
+
+func (s *countingQueueStore) Put(item *QueueItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.puts++
+	return nil
+}
+
+func (s *countingQueueStore) Done(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done++
+	return nil
+}
+
+func (s *countingQueueStore) Pending() ([]*QueueItem, error) { return nil, nil }
+func (s *countingQueueStore) Close() error                   { return nil }
+
+func TestThrottledDelivery(t *testing.T) {
+	e := New("example.com")
+	e.Resolver = &testResolver{}
+	e.ErrorLogger = func(err error) {}
+	e.OutgoingRateLimits = map[string]RateLimit{"example.net": {Connections: 1}}
+	handled := 0
+	e.DeliveryHandler = func(email *Email, results []DeliveryResult) { handled++ }
+
+	// Another delivery is using the only connection allowed
+	if _, ok := e.acquireDomain("example.net"); !ok {
+		t.Fatal("cannot reserve a delivery to the domain")
+	}
+
+	email := &Email{
+		ID:        "a",
+		MessageID: "a@example.com",
+		From:      Address{Address: "alice@example.com"},
+		To:        []Address{{Address: "bob@example.net"}},
+		Subject:   "Hello",
+		Content:   "Hello World!",
+	}
+	item := &QueueItem{
+		ID:          email.ID,
+		Email:       email,
+		QueuedAt:    time.Now(),
+		NextAttempt: time.Now(),
+		Results:     newDeliveryResults(email),
+	}
+	store := &countingQueueStore{}
+	e.outgoingQueue.push(item)
+	e.activeWorkers.Add(1)
+	go e.outgoingWorker(store)
+
+	// Wait for the worker to give up on the throttled item
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, _ := e.OutgoingStatusStore.GetStatus("a")
+		if status != nil && status.Recipients[0].Status == DeliveryDeferred {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("item was never throttled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	e.outgoingQueue.close()
+	e.activeWorkers.Wait()
+
+	// Throttled items are only requeued in memory
+	if store.puts != 0 || store.done != 0 {
+		t.Errorf("queue store was written to %d times", store.puts+store.done)
+	}
+	if handled != 0 {
+		t.Errorf("delivery handler was called %d times", handled)
+	}
+	if item.Attempts != 0 || item.Results[0].Attempts != 0 {
+		t.Errorf("throttled delivery counted as an attempt: %d, %d", item.Attempts, item.Results[0].Attempts)
+	}
+	if time.Until(item.NextAttempt) < throttleDelay/2 {
+		t.Errorf("item was not rescheduled after the throttle delay: %s", item.NextAttempt)
+	}
+	if e.outgoingQueue.len() != 1 {
+		t.Errorf("item was not requeued")
+	}
+}
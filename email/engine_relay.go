@@ -0,0 +1,131 @@
+package email
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// Determines how the connection to a Relay is secured
+type RelaySecurity int
+
+const (
+	RelaySTARTTLS    RelaySecurity = iota // Require STARTTLS with a verified certificate (Port 587)
+	RelayImplicitTLS                      // Connect using TLS with a verified certificate (Port 465)
+	RelayPlaintext                        // Never encrypt the connection, only use this for trusted networks
+)
+
+// An upstream server (smart host) which outgoing emails are relayed
+// through instead of being delivered to the recipient's mail exchanger
+type Relay struct {
+	Host      string        // Hostname of the Relay
+	Port      int           // Port of the Relay (Defaults to 587, or 465 for RelayImplicitTLS)
+	Security  RelaySecurity // Connection Security (Defaults to RelaySTARTTLS)
+	Username  string        // Username for SMTP AUTH, leave empty to disable authentication
+	Password  string        // Password for SMTP AUTH, or an access token when using XOAUTH2
+	Mechanism string        // SASL Mechanism: PLAIN, LOGIN, CRAM-MD5 or XOAUTH2 (Defaults to the strongest offered)
+	TLSConfig *tls.Config   // Base TLS Configuration, the server name is set per connection
+}
+
+// Returns the Relay for a recipient domain, or nil for direct delivery
+func (e *Engine) relayFor(domain string) *Relay {
+	if relay, ok := e.OutgoingRelayDomains[strings.ToLower(domain)]; ok {
+		return relay
+	}
+	return e.OutgoingRelay
+}
+
+// Connect and authenticate to a Relay
+func (e *Engine) dialRelay(ctx context.Context, relay *Relay) (*outgoingSession, error) {
+	port := relay.Port
+	if port == 0 && relay.Security == RelayImplicitTLS {
+		port = 465
+	} else if port == 0 {
+		port = 587
+	}
+	policy := TLSRequired
+	if relay.Security != RelaySTARTTLS {
+		policy = TLSDisabled
+	}
+	s, err := e.connect(ctx, relay.Host, port, policy, relay.Security == RelayImplicitTLS, relay.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	if relay.Username == "" {
+		return s, nil
+	}
+
+	// Authenticate
+	// 	Failures are reported as transient since they're a configuration issue
+	// 	on our end, which shouldn't bounce emails that can be retried later
+	mechanism := relay.Mechanism
+	if mechanism == "" {
+		for _, m := range []string{"CRAM-MD5", "PLAIN", "LOGIN"} {
+			if s.client.SupportsAuth(m) {
+				mechanism = m
+				break
+			}
+		}
+	}
+	var client sasl.Client
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		client = sasl.NewPlainClient("", relay.Username, relay.Password)
+	case "LOGIN":
+		client = sasl.NewLoginClient(relay.Username, relay.Password)
+	case "CRAM-MD5":
+		client = &cramMD5Client{relay.Username, relay.Password}
+	case "XOAUTH2":
+		client = &xoauth2Client{relay.Username, relay.Password}
+	default:
+		s.close()
+		return nil, fmt.Errorf("relay '%s' offers no supported authentication mechanism", relay.Host)
+	}
+	if err := s.client.Auth(client); err != nil {
+		s.close()
+		return nil, fmt.Errorf("relay authentication failed: %s", err)
+	}
+	return s, nil
+}
+
+// SASL CRAM-MD5 Client (RFC 2195)
+type cramMD5Client struct {
+	username string
+	secret   string
+}
+
+func (a *cramMD5Client) Start() (string, []byte, error) {
+	return "CRAM-MD5", nil, nil
+}
+
+func (a *cramMD5Client) Next(challenge []byte) ([]byte, error) {
+	mac := hmac.New(md5.New, []byte(a.secret))
+	mac.Write(challenge)
+	return fmt.Appendf(nil, "%s %s", a.username, hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// SASL XOAUTH2 Client, as used by Google and Microsoft
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Client) Start() (string, []byte, error) {
+	return "XOAUTH2", fmt.Appendf(nil, "user=%s\x01auth=Bearer %s\x01\x01", a.username, a.token), nil
+}
+
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	// The server sends a JSON error as a challenge which must be
+	// acknowledged with an empty response before it replies with a failure
+	if len(challenge) > 0 {
+		return []byte{}, nil
+	}
+	return nil, errors.New("unexpected server challenge")
+}
@@ -0,0 +1,407 @@
+package email
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Performs the DNS Lookups required by the Engine, satisfied by *net.Resolver.
+// Lookups that find no records should return a *net.DNSError with IsNotFound set.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// An optional interface for Resolvers which can report how long their answers
+// may be cached for, the system resolver does not expose this information
+type TTLResolver interface {
+	LookupMXTTL(ctx context.Context, name string) ([]*net.MX, time.Duration, error)
+	LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+	LookupTXTTTL(ctx context.Context, name string) ([]string, time.Duration, error)
+}
+
+// Resolve the mail exchangers for a domain in order of preference.
+// Following RFC 5321 a domain without MX records is its own exchanger if it
+// has an address, and following RFC 7505 a null MX rejects delivery outright.
+func (e *Engine) lookupExchangers(ctx context.Context, domain string) ([]*net.MX, error) {
+	records, err := e.Resolver.LookupMX(ctx, domain)
+	if err != nil && !isNotFound(err) {
+		return nil, transientError("cannot lookup mx records for outbound host '%s': %s", domain, err)
+	}
+
+	// Implicit MX
+	if len(records) == 0 {
+		addrs, err := e.Resolver.LookupIPAddr(ctx, domain)
+		if err != nil && !isNotFound(err) {
+			return nil, transientError("cannot lookup address records for outbound host '%s': %s", domain, err)
+		}
+		if len(addrs) == 0 {
+			return nil, permanentError("no mx or address records for outbound host '%s'", domain)
+		}
+		return []*net.MX{{Host: domain, Pref: 0}}, nil
+	}
+
+	// Null MX
+	exchangers := make([]*net.MX, 0, len(records))
+	for _, record := range records {
+		if record.Host == "." || record.Host == "" {
+			continue
+		}
+		exchangers = append(exchangers, record)
+	}
+	if len(exchangers) == 0 {
+		return nil, &DeliveryError{
+			Permanent:    true,
+			Code:         556,
+			EnhancedCode: "5.1.10",
+			Err:          fmt.Errorf("outbound host '%s' does not accept email (null mx)", domain),
+		}
+	}
+
+	sort.SliceStable(exchangers, func(i, j int) bool {
+		// These should already be sorted, but we sort them ourselves jic
+		return exchangers[i].Pref < exchangers[j].Pref
+	})
+	return exchangers, nil
+}
+
+// Reports whether a lookup error means the requested records do not exist
+func isNotFound(err error) bool {
+	var de *net.DNSError
+	return errors.As(err, &de) && de.IsNotFound
+}
+
+// A Resolver which caches answers from another Resolver.
+// Answers are kept for their TTL if the wrapped Resolver implements TTLResolver,
+// otherwise for DefaultTTL. Names which do not exist are kept for NegativeTTL.
+type CachingResolver struct {
+	Resolver    Resolver      // Wrapped Resolver
+	DefaultTTL  time.Duration // Cache Duration when TTLs are unknown (Defaults to 5 minutes)
+	MaxTTL      time.Duration // Upper bound on reported TTLs (Defaults to 1 hour)
+	NegativeTTL time.Duration // Cache Duration for missing records (Defaults to 1 minute)
+	mu          sync.Mutex
+	entries     map[string]cacheEntry
+	pruned      time.Time
+}
+
+type cacheEntry struct {
+	value   any
+	err     error
+	expires time.Time
+}
+
+// Wrap a Resolver with a cache using the default durations
+func NewCachingResolver(r Resolver) *CachingResolver {
+	return &CachingResolver{
+		Resolver:    r,
+		DefaultTTL:  5 * time.Minute,
+		MaxTTL:      time.Hour,
+		NegativeTTL: time.Minute,
+		entries:     make(map[string]cacheEntry),
+		pruned:      time.Now(),
+	}
+}
+
+func (c *CachingResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	v, err := c.lookup(ctx, "MX", name, func() (any, time.Duration, error) {
+		if t, ok := c.Resolver.(TTLResolver); ok {
+			return t.LookupMXTTL(ctx, name)
+		}
+		v, err := c.Resolver.LookupMX(ctx, name)
+		return v, -1, err
+	})
+	records, _ := v.([]*net.MX)
+	return records, err
+}
+
+func (c *CachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	v, err := c.lookup(ctx, "IP", host, func() (any, time.Duration, error) {
+		if t, ok := c.Resolver.(TTLResolver); ok {
+			return t.LookupIPAddrTTL(ctx, host)
+		}
+		v, err := c.Resolver.LookupIPAddr(ctx, host)
+		return v, -1, err
+	})
+	addrs, _ := v.([]net.IPAddr)
+	return addrs, err
+}
+
+func (c *CachingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	v, err := c.lookup(ctx, "TXT", name, func() (any, time.Duration, error) {
+		if t, ok := c.Resolver.(TTLResolver); ok {
+			return t.LookupTXTTTL(ctx, name)
+		}
+		v, err := c.Resolver.LookupTXT(ctx, name)
+		return v, -1, err
+	})
+	records, _ := v.([]string)
+	return records, err
+}
+
+// Return a cached answer or perform the lookup, a negative TTL means unknown
+func (c *CachingResolver) lookup(ctx context.Context, kind, name string, fn func() (any, time.Duration, error)) (any, error) {
+	key := kind + " " + strings.ToLower(strings.TrimSuffix(name, "."))
+	now := time.Now()
+
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok && now.Before(entry.expires) {
+		c.mu.Unlock()
+		return entry.value, entry.err
+	}
+	c.mu.Unlock()
+
+	value, ttl, err := fn()
+	switch {
+	case err != nil && isNotFound(err):
+		ttl = c.NegativeTTL
+	case err != nil:
+		// Temporary failures are never cached
+		return value, err
+	case ttl < 0:
+		ttl = c.DefaultTTL
+	case ttl > c.MaxTTL:
+		ttl = c.MaxTTL
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]cacheEntry)
+	}
+	c.entries[key] = cacheEntry{value: value, err: err, expires: now.Add(ttl)}
+
+	// Prune Expired Answers
+	// 	We only need to do this occasionally so we don't scan on every lookup
+	if now.Sub(c.pruned) > c.MaxTTL {
+		for k, v := range c.entries {
+			if now.After(v.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.pruned = now
+	}
+	return value, err
+}
+
+// A Resolver which queries nameservers directly and reports record TTLs,
+// allowing a CachingResolver to honor them
+type DNSResolver struct {
+	Servers []string      // Nameserver Addresses (e.g. "1.1.1.1:53")
+	Timeout time.Duration // Timeout per Query (Defaults to 5 seconds)
+}
+
+// Create a DNSResolver for the given nameservers, if none are provided the
+// nameservers configured in /etc/resolv.conf are used
+func NewDNSResolver(servers ...string) *DNSResolver {
+	if len(servers) == 0 {
+		if b, err := os.ReadFile("/etc/resolv.conf"); err == nil {
+			for _, line := range strings.Split(string(b), "\n") {
+				fields := strings.Fields(line)
+				if len(fields) >= 2 && fields[0] == "nameserver" {
+					servers = append(servers, net.JoinHostPort(fields[1], "53"))
+				}
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+	return &DNSResolver{Servers: servers, Timeout: 5 * time.Second}
+}
+
+func (d *DNSResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	records, _, err := d.LookupMXTTL(ctx, name)
+	return records, err
+}
+
+func (d *DNSResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, _, err := d.LookupIPAddrTTL(ctx, host)
+	return addrs, err
+}
+
+func (d *DNSResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, _, err := d.LookupTXTTTL(ctx, name)
+	return records, err
+}
+
+func (d *DNSResolver) LookupMXTTL(ctx context.Context, name string) ([]*net.MX, time.Duration, error) {
+	answers, ttl, err := d.query(ctx, name, dnsmessage.TypeMX)
+	if err != nil {
+		return nil, 0, err
+	}
+	records := make([]*net.MX, 0, len(answers))
+	for _, a := range answers {
+		if mx, ok := a.Body.(*dnsmessage.MXResource); ok {
+			records = append(records, &net.MX{Host: mx.MX.String(), Pref: mx.Pref})
+		}
+	}
+	return records, ttl, nil
+}
+
+func (d *DNSResolver) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	addrs := []net.IPAddr{}
+	ttl := time.Duration(-1)
+	var lastErr error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, t, err := d.query(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if ttl < 0 || t < ttl {
+			ttl = t
+		}
+		for _, a := range answers {
+			switch body := a.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, net.IPAddr{IP: net.IP(body.A[:])})
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, net.IPAddr{IP: net.IP(body.AAAA[:])})
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, 0, lastErr
+	}
+	return addrs, ttl, nil
+}
+
+func (d *DNSResolver) LookupTXTTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	answers, ttl, err := d.query(ctx, name, dnsmessage.TypeTXT)
+	if err != nil {
+		return nil, 0, err
+	}
+	records := make([]string, 0, len(answers))
+	for _, a := range answers {
+		if txt, ok := a.Body.(*dnsmessage.TXTResource); ok {
+			// Character strings of a single record are concatenated (RFC 7208 section 3.3)
+			records = append(records, strings.Join(txt.TXT, ""))
+		}
+	}
+	return records, ttl, nil
+}
+
+// Query each nameserver in turn until one answers, returning the answers of
+// the requested type and the lowest TTL among them
+func (d *DNSResolver) query(ctx context.Context, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, time.Duration, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: name}
+	}
+
+	// Unpredictable IDs prevent off-path attackers from spoofing answers
+	id := make([]byte, 2)
+	rand.Read(id)
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: binary.BigEndian.Uint16(id), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var lastErr error
+	for _, server := range d.Servers {
+		response, err := d.exchange(ctx, server, "udp", packed)
+		if err == nil && response.Truncated {
+			response, err = d.exchange(ctx, server, "tcp", packed)
+		}
+		if err != nil {
+			lastErr = &net.DNSError{Err: err.Error(), Name: name, Server: server, IsTemporary: true}
+			continue
+		}
+		if response.ID != query.ID {
+			lastErr = &net.DNSError{Err: "mismatched response id", Name: name, Server: server, IsTemporary: true}
+			continue
+		}
+		switch response.RCode {
+		case dnsmessage.RCodeSuccess:
+		case dnsmessage.RCodeNameError:
+			return nil, 0, &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+		default:
+			lastErr = &net.DNSError{Err: response.RCode.String(), Name: name, Server: server, IsTemporary: true}
+			continue
+		}
+		answers := []dnsmessage.Resource{}
+		ttl := time.Duration(-1)
+		for _, a := range response.Answers {
+			if a.Header.Type != qtype {
+				continue
+			}
+			answers = append(answers, a)
+			if t := time.Duration(a.Header.TTL) * time.Second; ttl < 0 || t < ttl {
+				ttl = t
+			}
+		}
+		if len(answers) == 0 {
+			return nil, 0, &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+		}
+		return answers, ttl, nil
+	}
+	return nil, 0, lastErr
+}
+
+// Send a packed query to a nameserver and parse the response
+func (d *DNSResolver) exchange(ctx context.Context, server, network string, packed []byte) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.Timeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Messages over TCP are prefixed with their length (RFC 1035 section 4.2.2)
+	buf := make([]byte, 65535)
+	var n int
+	if network == "tcp" {
+		if _, err := conn.Write(append([]byte{byte(len(packed) >> 8), byte(len(packed))}, packed...)); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return nil, err
+		}
+		n = int(buf[0])<<8 | int(buf[1])
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		if n, err = conn.Read(buf); err != nil {
+			return nil, err
+		}
+	}
+
+	var response dnsmessage.Message
+	if err := response.Unpack(buf[:n]); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
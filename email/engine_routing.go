@@ -0,0 +1,168 @@
+package email
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Determines what happens to an outgoing email matched by a Transport Rule
+type TransportAction int
+
+const (
+	TransportDirect  TransportAction = iota // Deliver to the mail exchangers of the recipient, ignoring OutgoingRelay
+	TransportRelay                          // Deliver through the Relay of the rule
+	TransportLocal                          // Deliver to a registered inbox without leaving the engine
+	TransportDiscard                        // Silently drop the email, it is reported as delivered
+)
+
+// A routing rule for outgoing emails matching the domain of their recipient
+type TransportRule struct {
+	Domain string          // Exact domain (e.g. "example.com") or wildcard matching any subdomain (e.g. "*.example.com")
+	Regexp *regexp.Regexp  // Matches the recipient domain instead of Domain, evaluated in order after all other rules
+	Action TransportAction // Action to take for matching recipients
+	Relay  *Relay          // Relay used by TransportRelay
+	Inbox  string          // Registered inbox used by TransportLocal (Defaults to the address of the recipient)
+}
+
+// A routing table for outgoing emails similar to Postfix transport maps.
+// Exact domains take precedence over wildcards, of which the most specific wins,
+// followed by regular expressions in the order they were given.
+// Rules can be replaced at runtime by calling Reload.
+type TransportMap struct {
+	mu        sync.RWMutex
+	exact     map[string]*TransportRule
+	wildcards []*TransportRule
+	patterns  []*TransportRule
+}
+
+// Create a Transport Map from the given rules
+func NewTransportMap(rules ...TransportRule) (*TransportMap, error) {
+	t := &TransportMap{}
+	if err := t.Reload(rules); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Atomically replace every rule in the map, the existing rules
+// are kept if any of the new rules are invalid
+func (t *TransportMap) Reload(rules []TransportRule) error {
+	exact := make(map[string]*TransportRule)
+	wildcards := []*TransportRule{}
+	patterns := []*TransportRule{}
+	for i := range rules {
+		rule := rules[i]
+		rule.Domain = strings.ToLower(strings.TrimSuffix(rule.Domain, "."))
+
+		// Validate Rule
+		if (rule.Domain == "") == (rule.Regexp == nil) {
+			return fmt.Errorf("transport rule %d must have either a domain or a regexp", i)
+		}
+		if rule.Action == TransportRelay && (rule.Relay == nil || rule.Relay.Host == "") {
+			return fmt.Errorf("transport rule %d relays without a relay host", i)
+		}
+		if rule.Action != TransportRelay {
+			rule.Relay = nil
+		}
+
+		// Categorize Rule
+		switch {
+		case rule.Regexp != nil:
+			patterns = append(patterns, &rule)
+		case strings.HasPrefix(rule.Domain, "*."):
+			wildcards = append(wildcards, &rule)
+		default:
+			if _, exists := exact[rule.Domain]; exists {
+				return fmt.Errorf("transport rule %d duplicates domain: %s", i, rule.Domain)
+			}
+			exact[rule.Domain] = &rule
+		}
+	}
+	sort.SliceStable(wildcards, func(i, j int) bool {
+		return len(wildcards[i].Domain) > len(wildcards[j].Domain)
+	})
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.exact, t.wildcards, t.patterns = exact, wildcards, patterns
+	return nil
+}
+
+// Returns the rule matching the given recipient domain, or nil if none match
+func (t *TransportMap) Lookup(domain string) *TransportRule {
+	if t == nil {
+		return nil
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if rule, ok := t.exact[domain]; ok {
+		return rule
+	}
+	for _, rule := range t.wildcards {
+		if strings.HasSuffix(domain, rule.Domain[1:]) {
+			return rule
+		}
+	}
+	for _, rule := range t.patterns {
+		if rule.Regexp.MatchString(domain) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Handle a recipient whose rule does not require an SMTP connection,
+// returns false if the recipient should be delivered over SMTP
+func (e *Engine) deliverTransport(item *QueueItem, addressee Address, rule *TransportRule, r *DeliveryResult) bool {
+	if rule == nil || (rule.Action != TransportLocal && rule.Action != TransportDiscard) {
+		return false
+	}
+	beginAttempt(r)
+	r.Host = "localhost"
+
+	// Discard Email
+	if rule.Action == TransportDiscard {
+		r.Status, r.Code, r.EnhancedCode, r.Message = DeliveryDelivered, 250, "2.0.0", "Discarded by transport map"
+		return true
+	}
+
+	// Deliver to Local Inbox
+	inbox := rule.Inbox
+	if inbox == "" {
+		inbox = addressee.Address
+	}
+	handler, ok := e.inbox(inbox)
+	if !ok {
+		r.Status, r.Code, r.EnhancedCode, r.Message = DeliveryBounced, 550, "5.1.1", "Unknown Recipient"
+		return true
+	}
+	// Prerendered emails are parsed so inboxes see their headers and report parts
+	email := *item.Email
+	if item.Raw != nil {
+		parsed, err := newEmailFromRaw(item.Raw)
+		if err != nil {
+			r.Status, r.Code, r.EnhancedCode, r.Message = DeliveryBounced, 554, "5.6.0", "Message is malformed"
+			return true
+		}
+		parsed.ID, parsed.MessageID = item.Email.ID, item.Email.MessageID
+		email = *parsed
+	}
+	// The envelope names the recipient, the headers are left as other recipients see them
+	email.Bcc = nil
+	email.RcptTo = []string{addressee.Address}
+	if !item.Bounce {
+		// Notifications are sent with a null sender
+		email.MailFrom = item.Email.From.Address
+	}
+	if err := handler(&email); err != nil {
+		e.ErrorLogger(fmt.Errorf("inbox handler encountered an error: %s", err))
+		r.Status, r.Code, r.EnhancedCode, r.Message = DeliveryDeferred, 451, "4.3.0", "Local inbox encountered an error"
+		return true
+	}
+	r.Status, r.Code, r.EnhancedCode, r.Message = DeliveryDelivered, 250, "2.0.0", "Delivered to local inbox"
+	return true
+}
@@ -0,0 +1,48 @@
+package email
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDeliverTransportLocal(t *testing.T) {
+	e := New("example.com")
+	var received *Email
+	e.RegisterInbox("bob", func(email *Email) error {
+		received = email
+		return nil
+	})
+
+	item := &QueueItem{
+		ID: "a",
+		Email: &Email{
+			From:    Address{Address: "alice@example.org"},
+			To:      []Address{{Address: "carol@example.net"}},
+			Cc:      []Address{{Address: "dave@example.net"}},
+			Bcc:     []Address{{Address: "bob@example.com"}, {Address: "erin@example.net"}},
+			Subject: "Hello",
+		},
+	}
+	var r DeliveryResult
+	rule := &TransportRule{Domain: "example.com", Action: TransportLocal}
+	if !e.deliverTransport(item, Address{Address: "bob@example.com"}, rule, &r) {
+		t.Fatal("recipient was not handled by the transport")
+	}
+	if r.Status != DeliveryDelivered || received == nil {
+		t.Fatalf("got %s %d %s, want delivered", r.Status, r.Code, r.Message)
+	}
+
+	// Local inboxes see the same headers as remote recipients
+	if len(received.Bcc) != 0 {
+		t.Errorf("bcc recipients were disclosed: %v", received.Bcc)
+	}
+	if !slices.Equal(received.To, item.Email.To) || !slices.Equal(received.Cc, item.Email.Cc) {
+		t.Errorf("got To %v and Cc %v, want the original headers", received.To, received.Cc)
+	}
+	if !slices.Equal(received.RcptTo, []string{"bob@example.com"}) || received.MailFrom != "alice@example.org" {
+		t.Errorf("got envelope %q -> %v", received.MailFrom, received.RcptTo)
+	}
+	if len(item.Email.Bcc) != 2 {
+		t.Errorf("queued email was changed: %v", item.Email.Bcc)
+	}
+}
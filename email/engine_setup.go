@@ -2,6 +2,7 @@ package email
 
 import (
 	"crypto"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
@@ -38,20 +39,34 @@ func LoadTLSConfig(cert string, key string, ca string) (*tls.Config, error) {
 	}, nil
 }
 
-// Provide a path to an PKCS#8 Encoded RSA Private Key. Returning a crypto.Signer instance
+// Provide a path to a PEM Encoded RSA (PKCS#1 or PKCS#8) or Ed25519 (PKCS#8) Private Key.
+// Returning a crypto.Signer instance
 func LoadDKIMSigner(key string) (crypto.Signer, error) {
 	b, err := os.ReadFile(key)
 	if err != nil {
 		return nil, err
 	}
 	p, _ := pem.Decode(b)
+	if p == nil {
+		return nil, errors.New("expected pem encoded private key")
+	}
+	if p.Type == "RSA PRIVATE KEY" {
+		pkey, err := x509.ParsePKCS1PrivateKey(p.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return pkey, nil
+	}
 	pkey, err := x509.ParsePKCS8PrivateKey(p.Bytes)
 	if err != nil {
 		return nil, err
 	}
-	v, ok := pkey.(*rsa.PrivateKey)
-	if !ok {
-		return nil, errors.New("expected rsa private key")
+	switch v := pkey.(type) {
+	case *rsa.PrivateKey:
+		return v, nil
+	case ed25519.PrivateKey:
+		return v, nil
+	default:
+		return nil, errors.New("expected rsa or ed25519 private key")
 	}
-	return v, nil
 }
@@ -0,0 +1,547 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// The result of an SPF check (RFC 7208 Section 2.6)
+type SPFResult string
+
+const (
+	SPFNone      SPFResult = "none"
+	SPFNeutral   SPFResult = "neutral"
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftFail  SPFResult = "softfail"
+	SPFTempError SPFResult = "temperror"
+	SPFPermError SPFResult = "permerror"
+)
+
+// Determines what happens to an incoming email for an SPF Result
+type SPFAction int
+
+const (
+	SPFAccept SPFAction = iota // Accept the email, middleware can still inspect the result
+	SPFDefer                   // Temporarily reject the email at MAIL FROM
+	SPFReject                  // Permanently reject the email at MAIL FROM
+)
+
+// The outcome of checking an incoming email against the SPF policy of its sender
+type SPFCheck struct {
+	Result   SPFResult // Result of the check
+	Identity string    // Identity which was checked, either "mailfrom" or "helo"
+	Domain   string    // Domain whose policy was evaluated
+	ClientIP net.IP    // Address of the connecting client
+	Reason   string    // Mechanism which matched or the error encountered
+}
+
+// Limits from RFC 7208 Section 4.6.4
+const (
+	spfMaxLookups     = 10
+	spfMaxVoidLookups = 2
+	spfMaxMXHosts     = 10
+)
+
+var (
+	errSPFLimit     = errors.New("too many dns lookups")
+	errSPFTemporary = errors.New("temporary dns error")
+)
+
+// Check the SPF policy of the sender of an incoming email, the MAIL FROM
+// domain is checked unless the sender is null in which case HELO is used
+func (e *Engine) checkSPF(ctx context.Context, ip net.IP, helo, mailFrom string) *SPFCheck {
+	check := &SPFCheck{Identity: "mailfrom", ClientIP: ip}
+	sender := mailFrom
+	if sender == "" {
+		check.Identity = "helo"
+		sender = "postmaster@" + helo
+	} else if !strings.Contains(sender, "@") {
+		sender = "postmaster@" + sender
+	}
+	check.Domain = domainOf(sender)
+
+	s := &spfEvaluator{
+		ctx:      ctx,
+		resolver: e.Resolver,
+		ip:       ip,
+		sender:   sender,
+		helo:     helo,
+	}
+	check.Result, check.Reason = s.checkHost(check.Domain, 0)
+	return check
+}
+
+// Returns the SMTP error for a check according to the configured actions, or
+// nil if the email should be accepted
+func (e *Engine) spfError(check *SPFCheck) error {
+	switch e.IncomingSPFActions[check.Result] {
+	case SPFDefer:
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 24},
+			Message:      fmt.Sprintf("SPF check returned %s for %s", check.Result, check.Domain),
+		}
+	case SPFReject:
+		enhanced := smtp.EnhancedCode{5, 7, 23}
+		if check.Result == SPFPermError || check.Result == SPFTempError {
+			enhanced = smtp.EnhancedCode{5, 7, 24}
+		}
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: enhanced,
+			Message:      fmt.Sprintf("SPF check returned %s for %s", check.Result, check.Domain),
+		}
+	default:
+		return nil
+	}
+}
+
+// State for a single evaluation, shared across include and redirect
+type spfEvaluator struct {
+	ctx      context.Context
+	resolver Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+	lookups  int // Terms which caused DNS lookups
+	voids    int // Lookups which returned no records
+}
+
+type spfTerm struct {
+	qualifier byte
+	mechanism string
+	value     string
+}
+
+// The check_host() function (RFC 7208 Section 4)
+func (s *spfEvaluator) checkHost(domain string, depth int) (SPFResult, string) {
+	if !validSPFDomain(domain) {
+		return SPFNone, "invalid domain"
+	}
+	if depth > spfMaxLookups {
+		return SPFPermError, "too many nested records"
+	}
+
+	// Find Record
+	txts, err := s.resolver.LookupTXT(s.ctx, domain)
+	if err != nil && !isNotFound(err) {
+		return SPFTempError, fmt.Sprintf("cannot lookup spf record for %s: %s", domain, err)
+	}
+	var records []string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return SPFNone, "no spf record for " + domain
+	case 1:
+	default:
+		return SPFPermError, "multiple spf records for " + domain
+	}
+
+	// Parse Record
+	// 	The entire record is parsed before evaluation so syntax errors are
+	// 	reported regardless of which mechanism would have matched
+	var terms []spfTerm
+	var redirect string
+	hasRedirect, hasExp := false, false
+	for _, field := range strings.Fields(records[0])[1:] {
+		if name, value, ok := strings.Cut(field, "="); ok && validSPFName(name) {
+			switch strings.ToLower(name) {
+			case "redirect":
+				if hasRedirect {
+					return SPFPermError, "duplicate redirect modifier"
+				}
+				hasRedirect, redirect = true, value
+			case "exp":
+				if hasExp {
+					return SPFPermError, "duplicate exp modifier"
+				}
+				hasExp = true
+			}
+			continue
+		}
+		term := spfTerm{qualifier: '+'}
+		if strings.IndexByte("+-~?", field[0]) >= 0 {
+			term.qualifier, field = field[0], field[1:]
+		}
+		name, value, _ := strings.Cut(field, ":")
+		if i := strings.IndexByte(name, '/'); i >= 0 && value == "" {
+			// CIDR lengths without a domain e.g. "a/24"
+			name, value = name[:i], name[i:]
+		}
+		term.mechanism = strings.ToLower(name)
+		term.value = value
+		switch term.mechanism {
+		case "all", "include", "a", "mx", "ptr", "ip4", "ip6", "exists":
+		default:
+			return SPFPermError, "unknown mechanism: " + name
+		}
+		terms = append(terms, term)
+	}
+
+	// Evaluate Mechanisms
+	for _, term := range terms {
+		matched, err := s.match(term, domain, depth)
+		if err != nil {
+			if errors.Is(err, errSPFTemporary) {
+				return SPFTempError, err.Error()
+			}
+			return SPFPermError, err.Error()
+		}
+		if matched {
+			return spfQualifierResult(term.qualifier), term.mechanism
+		}
+	}
+
+	// Follow Redirect
+	// 	This is ignored if the record contains an all mechanism
+	if hasRedirect && !slices.ContainsFunc(terms, func(t spfTerm) bool { return t.mechanism == "all" }) {
+		if err := s.countLookup(); err != nil {
+			return SPFPermError, err.Error()
+		}
+		target, err := s.expand(redirect, domain)
+		if err != nil {
+			return SPFPermError, err.Error()
+		}
+		result, reason := s.checkHost(target, depth+1)
+		if result == SPFNone {
+			return SPFPermError, "redirect target has no spf record: " + target
+		}
+		return result, reason
+	}
+	return SPFNeutral, "no mechanism matched"
+}
+
+// Evaluate a single mechanism against the client
+func (s *spfEvaluator) match(term spfTerm, domain string, depth int) (bool, error) {
+	switch term.mechanism {
+	case "all":
+		return true, nil
+
+	case "include":
+		if err := s.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := s.expand(term.value, domain)
+		if err != nil || term.value == "" {
+			return false, fmt.Errorf("invalid include: %s", term.value)
+		}
+		result, reason := s.checkHost(target, depth+1)
+		switch result {
+		case SPFPass:
+			return true, nil
+		case SPFFail, SPFSoftFail, SPFNeutral:
+			return false, nil
+		case SPFTempError:
+			return false, fmt.Errorf("%w: %s", errSPFTemporary, reason)
+		default:
+			return false, fmt.Errorf("include of %s returned %s: %s", target, result, reason)
+		}
+
+	case "a", "mx":
+		if err := s.countLookup(); err != nil {
+			return false, err
+		}
+		spec, cidr4, cidr6, err := parseSPFCIDR(term.value)
+		if err != nil {
+			return false, err
+		}
+		target := domain
+		if spec != "" {
+			if target, err = s.expand(spec, domain); err != nil {
+				return false, err
+			}
+		}
+		hosts := []string{target}
+		if term.mechanism == "mx" {
+			records, err := s.resolver.LookupMX(s.ctx, target)
+			if err := s.lookupError(err, len(records)); err != nil {
+				return false, err
+			}
+			if len(records) > spfMaxMXHosts {
+				return false, fmt.Errorf("too many mx records for %s", target)
+			}
+			hosts = hosts[:0]
+			for _, mx := range records {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			addrs, err := s.resolver.LookupIPAddr(s.ctx, host)
+			if err := s.lookupError(err, len(addrs)); err != nil {
+				return false, err
+			}
+			for _, addr := range addrs {
+				if matchSPFAddr(s.ip, addr.IP, cidr4, cidr6) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+
+	case "ptr":
+		// The ptr mechanism is deprecated and Resolver has no reverse lookups,
+		// so it never matches but still counts towards the lookup limit
+		return false, s.countLookup()
+
+	case "ip4", "ip6":
+		network := term.value
+		if !strings.Contains(network, "/") {
+			if term.mechanism == "ip4" {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil || (term.mechanism == "ip4") != (ipnet.IP.To4() != nil) {
+			return false, fmt.Errorf("invalid %s network: %s", term.mechanism, term.value)
+		}
+		return ipnet.Contains(s.ip), nil
+
+	case "exists":
+		if err := s.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := s.expand(term.value, domain)
+		if err != nil || term.value == "" {
+			return false, fmt.Errorf("invalid exists: %s", term.value)
+		}
+		addrs, err := s.resolver.LookupIPAddr(s.ctx, target)
+		if err := s.lookupError(err, len(addrs)); err != nil {
+			return false, err
+		}
+		return slices.ContainsFunc(addrs, func(a net.IPAddr) bool { return a.IP.To4() != nil }), nil
+	}
+	return false, fmt.Errorf("unknown mechanism: %s", term.mechanism)
+}
+
+// Count a term which causes DNS lookups against the limit
+func (s *spfEvaluator) countLookup() error {
+	s.lookups++
+	if s.lookups > spfMaxLookups {
+		return errSPFLimit
+	}
+	return nil
+}
+
+// Classify the result of a DNS lookup, counting lookups which found nothing
+func (s *spfEvaluator) lookupError(err error, found int) error {
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("%w: %s", errSPFTemporary, err)
+	}
+	if found == 0 {
+		s.voids++
+		if s.voids > spfMaxVoidLookups {
+			return errors.New("too many void dns lookups")
+		}
+	}
+	return nil
+}
+
+// Expand the macros in a domain-spec (RFC 7208 Section 7)
+func (s *spfEvaluator) expand(spec, domain string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", fmt.Errorf("invalid macro: %s", spec)
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", fmt.Errorf("invalid macro: %s", spec)
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", fmt.Errorf("invalid macro: %s", spec)
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		// Macro Letter
+		local, senderDomain, _ := strings.Cut(s.sender, "@")
+		if local == "" {
+			local = "postmaster"
+		}
+		var value string
+		switch strings.ToLower(macro[:1]) {
+		case "s":
+			value = s.sender
+		case "l":
+			value = local
+		case "o":
+			value = senderDomain
+		case "d":
+			value = domain
+		case "i":
+			value = spfAddress(s.ip)
+		case "p":
+			value = "unknown"
+		case "v":
+			value = "ip6"
+			if s.ip.To4() != nil {
+				value = "in-addr"
+			}
+		case "h":
+			value = s.helo
+		default:
+			return "", fmt.Errorf("invalid macro letter: %s", macro)
+		}
+
+		// Transformers and Delimiters
+		rest := macro[1:]
+		digits := 0
+		for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+			digits++
+		}
+		keep, _ := strconv.Atoi(rest[:digits])
+		rest = rest[digits:]
+		reverse := strings.HasPrefix(strings.ToLower(rest), "r")
+		if reverse {
+			rest = rest[1:]
+		}
+		delimiters := "."
+		if rest != "" {
+			if strings.Trim(rest, ".-+,/_=") != "" {
+				return "", fmt.Errorf("invalid macro delimiter: %s", macro)
+			}
+			delimiters = rest
+		}
+		parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+		if reverse {
+			slices.Reverse(parts)
+		}
+		if keep > 0 && keep < len(parts) {
+			parts = parts[len(parts)-keep:]
+		}
+		value = strings.Join(parts, ".")
+		if macro[0] >= 'A' && macro[0] <= 'Z' {
+			value = url.QueryEscape(value)
+		}
+		b.WriteString(value)
+	}
+
+	// Long names are truncated from the left
+	expanded := b.String()
+	for len(expanded) > 253 {
+		_, after, ok := strings.Cut(expanded, ".")
+		if !ok {
+			break
+		}
+		expanded = after
+	}
+	return expanded, nil
+}
+
+// Format an address for the i macro, IPv6 addresses are written as dotted nibbles
+func spfAddress(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, strconv.FormatUint(uint64(b>>4), 16), strconv.FormatUint(uint64(b&0xf), 16))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// Split the CIDR lengths from the value of an a or mx mechanism
+func parseSPFCIDR(value string) (spec string, cidr4, cidr6 int, err error) {
+	cidr4, cidr6 = 32, 128
+	spec, v6, hasV6 := strings.Cut(value, "//")
+	if hasV6 {
+		if cidr6, err = strconv.Atoi(v6); err != nil || cidr6 < 0 || cidr6 > 128 {
+			return "", 0, 0, fmt.Errorf("invalid ip6 cidr length: %s", value)
+		}
+	}
+	if i := strings.LastIndexByte(spec, '/'); i >= 0 {
+		if cidr4, err = strconv.Atoi(spec[i+1:]); err != nil || cidr4 < 0 || cidr4 > 32 {
+			return "", 0, 0, fmt.Errorf("invalid ip4 cidr length: %s", value)
+		}
+		spec = spec[:i]
+	}
+	return spec, cidr4, cidr6, nil
+}
+
+// Reports whether the client is within the network of a resolved address
+func matchSPFAddr(client, addr net.IP, cidr4, cidr6 int) bool {
+	if v4 := addr.To4(); v4 != nil {
+		if client.To4() == nil {
+			return false
+		}
+		return v4.Mask(net.CIDRMask(cidr4, 32)).Equal(client.To4().Mask(net.CIDRMask(cidr4, 32)))
+	}
+	if client.To4() != nil {
+		return false
+	}
+	return addr.Mask(net.CIDRMask(cidr6, 128)).Equal(client.To16().Mask(net.CIDRMask(cidr6, 128)))
+}
+
+// Returns the result for a matching mechanism's qualifier
+func spfQualifierResult(qualifier byte) SPFResult {
+	switch qualifier {
+	case '-':
+		return SPFFail
+	case '~':
+		return SPFSoftFail
+	case '?':
+		return SPFNeutral
+	default:
+		return SPFPass
+	}
+}
+
+// Reports whether a modifier name is valid, distinguishing them from mechanisms
+func validSPFName(name string) bool {
+	if name == "" || !isAlpha(name[0]) {
+		return false
+	}
+	return !strings.ContainsFunc(name, func(r rune) bool {
+		return !(r < 128 && (isAlpha(byte(r)) || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.'))
+	})
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// Reports whether a domain can be checked, it must be fully qualified
+// and its labels must be within the length limits
+func validSPFDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" || len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
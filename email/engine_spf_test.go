@@ -0,0 +1,333 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+// A Resolver answering from fixed records, names are case insensitive
+type testResolver struct {
+	txt  map[string][]string
+	mx   map[string][]*net.MX
+	ip   map[string][]string
+	fail map[string]bool // Names which fail with a temporary error
+}
+
+func (r *testResolver) lookup(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if r.fail[name] {
+		return "", &net.DNSError{Err: "server failure", Name: name, IsTemporary: true}
+	}
+	return name, nil
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	name, err := r.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if txts, ok := r.txt[name]; ok {
+		return txts, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *testResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	name, err := r.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if records, ok := r.mx[name]; ok {
+		return records, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	host, err := r.lookup(host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []net.IPAddr{}
+	for _, ip := range r.ip[host] {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	if len(addrs) == 0 {
+		return nil, notFound(host)
+	}
+	return addrs, nil
+}
+
+// The zone used by the examples of RFC 7208 Appendix A
+func newSPFTestResolver(record string) *testResolver {
+	return &testResolver{
+		txt: map[string][]string{
+			"example.com": {record},
+		},
+		mx: map[string][]*net.MX{
+			"example.com": {{Host: "mail-a.example.com.", Pref: 10}, {Host: "mail-b.example.com.", Pref: 20}},
+			"example.org": {{Host: "mail-c.example.org.", Pref: 10}},
+		},
+		ip: map[string][]string{
+			"example.com":        {"192.0.2.10", "192.0.2.11"},
+			"amy.example.com":    {"192.0.2.65"},
+			"bob.example.com":    {"192.0.2.66"},
+			"mail-a.example.com": {"192.0.2.129"},
+			"mail-b.example.com": {"192.0.2.130"},
+			"www.example.com":    {"192.0.2.10", "192.0.2.11"},
+			"mail-c.example.org": {"192.0.2.140"},
+		},
+		fail: map[string]bool{},
+	}
+}
+
+func TestSPFAppendixExamples(t *testing.T) {
+	tests := []struct {
+		record string
+		ip     string
+		want   SPFResult
+	}{
+		// RFC 7208 Appendix A.1
+		{"v=spf1 +all", "192.0.2.200", SPFPass},
+		{"v=spf1 a -all", "192.0.2.10", SPFPass},
+		{"v=spf1 a -all", "192.0.2.11", SPFPass},
+		{"v=spf1 a -all", "192.0.2.65", SPFFail},
+		{"v=spf1 a:example.org -all", "192.0.2.10", SPFFail},
+		{"v=spf1 mx -all", "192.0.2.129", SPFPass},
+		{"v=spf1 mx -all", "192.0.2.130", SPFPass},
+		{"v=spf1 mx -all", "192.0.2.10", SPFFail},
+		{"v=spf1 mx:example.org -all", "192.0.2.140", SPFPass},
+		{"v=spf1 mx:example.org -all", "192.0.2.129", SPFFail},
+		{"v=spf1 mx mx:example.org -all", "192.0.2.129", SPFPass},
+		{"v=spf1 mx mx:example.org -all", "192.0.2.130", SPFPass},
+		{"v=spf1 mx mx:example.org -all", "192.0.2.140", SPFPass},
+		{"v=spf1 mx/30 mx:example.org/30 -all", "192.0.2.131", SPFPass},
+		{"v=spf1 mx/30 mx:example.org/30 -all", "192.0.2.143", SPFPass},
+		{"v=spf1 mx/30 mx:example.org/30 -all", "192.0.2.132", SPFFail},
+		{"v=spf1 ip4:192.0.2.128/28 -all", "192.0.2.65", SPFFail},
+		{"v=spf1 ip4:192.0.2.128/28 -all", "192.0.2.129", SPFPass},
+		{"v=spf1 ptr -all", "192.0.2.65", SPFFail}, // ptr never matches
+
+		// Qualifiers and Defaults
+		{"v=spf1 ~all", "192.0.2.1", SPFSoftFail},
+		{"v=spf1 ?all", "192.0.2.1", SPFNeutral},
+		{"v=spf1", "192.0.2.1", SPFNeutral},
+		{"v=spf1 ip6:2001:db8::/32 -all", "2001:db8::1", SPFPass},
+		{"v=spf1 ip6:2001:db8::/32 -all", "192.0.2.1", SPFFail},
+		{"v=spf1 a//64 -all", "2001:db8::1", SPFFail},
+
+		// Errors
+		{"v=spf1 foo -all", "192.0.2.1", SPFPermError},
+		{"v=spf1 ip4:192.0.2.300 -all", "192.0.2.1", SPFPermError},
+		{"v=spf1 a/33 -all", "192.0.2.1", SPFPermError},
+		{"v=spf1 redirect=a.example.com redirect=b.example.com", "192.0.2.1", SPFPermError},
+		{"v=spf1 redirect=nowhere.example.com", "192.0.2.1", SPFPermError},
+		{"v=spf1 include:nowhere.example.com -all", "192.0.2.1", SPFPermError},
+		{"v=spf1 a:broken.example.com -all", "192.0.2.1", SPFTempError},
+	}
+	for _, test := range tests {
+		e := New("mx.example.net")
+		resolver := newSPFTestResolver(test.record)
+		resolver.fail["broken.example.com"] = true
+		e.Resolver = resolver
+		check := e.checkSPF(context.Background(), net.ParseIP(test.ip), "mail.example.com", "user@example.com")
+		if check.Result != test.want {
+			t.Errorf("%q from %s: got %s (%s), want %s", test.record, test.ip, check.Result, check.Reason, test.want)
+		}
+	}
+}
+
+func TestSPFRecords(t *testing.T) {
+	tests := []struct {
+		name string
+		txt  map[string][]string
+		want SPFResult
+	}{
+		{"no record", map[string][]string{"example.com": {"some other record"}}, SPFNone},
+		{"multiple records", map[string][]string{"example.com": {"v=spf1 -all", "v=spf1 +all"}}, SPFPermError},
+		{"include pass", map[string][]string{
+			"example.com":      {"v=spf1 include:_spf.example.com -all"},
+			"_spf.example.com": {"v=spf1 ip4:192.0.2.0/24 -all"},
+		}, SPFPass},
+		{"include fail does not match", map[string][]string{
+			"example.com":      {"v=spf1 include:_spf.example.com ~all"},
+			"_spf.example.com": {"v=spf1 -all"},
+		}, SPFSoftFail},
+		{"redirect", map[string][]string{
+			"example.com":      {"v=spf1 redirect=_spf.example.com"},
+			"_spf.example.com": {"v=spf1 ip4:192.0.2.1 -all"},
+		}, SPFPass},
+		{"redirect ignored with all", map[string][]string{
+			"example.com":      {"v=spf1 -all redirect=_spf.example.com"},
+			"_spf.example.com": {"v=spf1 +all"},
+		}, SPFFail},
+		{"exists", map[string][]string{
+			"example.com": {"v=spf1 exists:%{ir}.allow.example.com -all"},
+		}, SPFPass},
+		{"too many lookups", map[string][]string{
+			"example.com": {"v=spf1 " + strings.Repeat("a:amy.example.com ", 11) + "-all"},
+		}, SPFPermError},
+		{"ten lookups allowed", map[string][]string{
+			"example.com": {"v=spf1 " + strings.Repeat("a:amy.example.com ", 10) + "+all"},
+		}, SPFPass},
+		{"too many void lookups", map[string][]string{
+			"example.com": {"v=spf1 a:void1.example.com a:void2.example.com a:void3.example.com +all"},
+		}, SPFPermError},
+		{"two void lookups allowed", map[string][]string{
+			"example.com": {"v=spf1 a:void1.example.com a:void2.example.com +all"},
+		}, SPFPass},
+		{"include loop", map[string][]string{
+			"example.com": {"v=spf1 include:example.com -all"},
+		}, SPFPermError},
+	}
+	for _, test := range tests {
+		e := New("mx.example.net")
+		e.Resolver = &testResolver{
+			txt: test.txt,
+			ip: map[string][]string{
+				"amy.example.com":             {"192.0.2.65"},
+				"1.2.0.192.allow.example.com": {"127.0.0.2"},
+			},
+		}
+		check := e.checkSPF(context.Background(), net.ParseIP("192.0.2.1"), "mail.example.com", "user@example.com")
+		if check.Result != test.want {
+			t.Errorf("%s: got %s (%s), want %s", test.name, check.Result, check.Reason, test.want)
+		}
+	}
+}
+
+func TestSPFIdentity(t *testing.T) {
+	e := New("mx.example.net")
+	e.Resolver = &testResolver{txt: map[string][]string{"mail.example.org": {"v=spf1 +all"}}}
+	check := e.checkSPF(context.Background(), net.ParseIP("192.0.2.1"), "mail.example.org", "")
+	if check.Identity != "helo" || check.Domain != "mail.example.org" || check.Result != SPFPass {
+		t.Errorf("null sender: got %+v", check)
+	}
+	check = e.checkSPF(context.Background(), net.ParseIP("192.0.2.1"), "mail.example.org", "user@Example.COM")
+	if check.Identity != "mailfrom" || check.Domain != "example.com" || check.Result != SPFNone {
+		t.Errorf("sender: got %+v", check)
+	}
+}
+
+func TestSPFMacros(t *testing.T) {
+	// RFC 7208 Section 7.4
+	tests := []struct {
+		ip   string
+		spec string
+		want string
+	}{
+		{"192.0.2.3", "%{s}", "strong-bad@email.example.com"},
+		{"192.0.2.3", "%{o}", "email.example.com"},
+		{"192.0.2.3", "%{d}", "email.example.com"},
+		{"192.0.2.3", "%{d4}", "email.example.com"},
+		{"192.0.2.3", "%{d3}", "email.example.com"},
+		{"192.0.2.3", "%{d2}", "example.com"},
+		{"192.0.2.3", "%{d1}", "com"},
+		{"192.0.2.3", "%{dr}", "com.example.email"},
+		{"192.0.2.3", "%{d2r}", "example.email"},
+		{"192.0.2.3", "%{l}", "strong-bad"},
+		{"192.0.2.3", "%{l-}", "strong.bad"},
+		{"192.0.2.3", "%{lr}", "strong-bad"},
+		{"192.0.2.3", "%{lr-}", "bad.strong"},
+		{"192.0.2.3", "%{l1r-}", "strong"},
+		{"192.0.2.3", "%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com"},
+		{"192.0.2.3", "%{lr-}.lp._spf.%{d2}", "bad.strong.lp._spf.example.com"},
+		{"192.0.2.3", "%{lr-}.lp.%{ir}.%{v}._spf.%{d2}", "bad.strong.lp.3.2.0.192.in-addr._spf.example.com"},
+		{"192.0.2.3", "%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}", "3.2.0.192.in-addr.strong.lp._spf.example.com"},
+		{"192.0.2.3", "%{d2}.trusted-domains.example.net", "example.com.trusted-domains.example.net"},
+		{"2001:db8::cb01", "%{ir}.%{v}._spf.%{d2}", "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"},
+
+		// Escapes and URL Encoding
+		{"192.0.2.3", "%%%_%-", "% %20"},
+		{"192.0.2.3", "%{S}", "strong-bad%40email.example.com"},
+		{"192.0.2.3", "%{h}", "mail.example.org"},
+	}
+	for _, test := range tests {
+		s := &spfEvaluator{
+			ip:     net.ParseIP(test.ip),
+			sender: "strong-bad@email.example.com",
+			helo:   "mail.example.org",
+		}
+		got, err := s.expand(test.spec, "email.example.com")
+		if err != nil || got != test.want {
+			t.Errorf("%s from %s: got %q (%v), want %q", test.spec, test.ip, got, err, test.want)
+		}
+	}
+
+	for _, spec := range []string{"%", "%{", "%{x}", "%{l!}", "%a"} {
+		s := &spfEvaluator{ip: net.ParseIP("192.0.2.3"), sender: "a@example.com"}
+		if _, err := s.expand(spec, "example.com"); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestSPFCIDR(t *testing.T) {
+	tests := []struct {
+		value        string
+		spec         string
+		cidr4, cidr6 int
+		fails        bool
+	}{
+		{"", "", 32, 128, false},
+		{"/24", "", 24, 128, false},
+		{"//64", "", 32, 64, false},
+		{"/24//64", "", 24, 64, false},
+		{"example.com", "example.com", 32, 128, false},
+		{"example.com/0", "example.com", 0, 128, false},
+		{"example.com/24//64", "example.com", 24, 64, false},
+		{"/33", "", 0, 0, true},
+		{"//129", "", 0, 0, true},
+		{"/x", "", 0, 0, true},
+	}
+	for _, test := range tests {
+		spec, cidr4, cidr6, err := parseSPFCIDR(test.value)
+		if (err != nil) != test.fails {
+			t.Errorf("%q: got error %v", test.value, err)
+			continue
+		}
+		if !test.fails && (spec != test.spec || cidr4 != test.cidr4 || cidr6 != test.cidr6) {
+			t.Errorf("%q: got %q %d %d", test.value, spec, cidr4, cidr6)
+		}
+	}
+}
+
+func TestSPFError(t *testing.T) {
+	e := New("mx.example.net")
+	e.IncomingSPFActions = map[SPFResult]SPFAction{
+		SPFFail:      SPFReject,
+		SPFTempError: SPFDefer,
+		SPFPermError: SPFReject,
+	}
+	tests := []struct {
+		result   SPFResult
+		code     int
+		enhanced smtp.EnhancedCode
+	}{
+		{SPFPass, 0, smtp.EnhancedCode{}},
+		{SPFSoftFail, 0, smtp.EnhancedCode{}},
+		{SPFFail, 550, smtp.EnhancedCode{5, 7, 23}},
+		{SPFTempError, 451, smtp.EnhancedCode{4, 7, 24}},
+		{SPFPermError, 550, smtp.EnhancedCode{5, 7, 24}},
+	}
+	for _, test := range tests {
+		err := e.spfError(&SPFCheck{Result: test.result, Domain: "example.com"})
+		var smtpErr *smtp.SMTPError
+		if test.code == 0 {
+			if err != nil {
+				t.Errorf("%s: got %v, want nil", test.result, err)
+			}
+		} else if !errors.As(err, &smtpErr) || smtpErr.Code != test.code || smtpErr.EnhancedCode != test.enhanced {
+			t.Errorf("%s: got %v, want %d %v", test.result, err, test.code, test.enhanced)
+		}
+	}
+}
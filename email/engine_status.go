@@ -0,0 +1,112 @@
+package email
+
+import (
+	"sync"
+	"time"
+)
+
+// Storage for the Delivery Status of Queued Emails, updated by the outgoing workers
+type StatusStore interface {
+	SetStatus(status *MessageStatus) error       // Create or replace the status for a message
+	GetStatus(id string) (*MessageStatus, error) // Returns nil if no status exists for the given id
+}
+
+// Delivery Status of a Queued Email as reported by GET /messages/{id}
+type MessageStatus struct {
+	ID         string           `json:"id"`
+	MessageID  string           `json:"message_id"`
+	Status     DeliveryStatus   `json:"status"`
+	QueuedAt   time.Time        `json:"queued_at"`
+	SendAt     time.Time        `json:"send_at,omitzero"`
+	UpdatedAt  time.Time        `json:"updated_at"`
+	Recipients []DeliveryResult `json:"recipients"`
+}
+
+// Record the current state of a Queued Email, the override status (if not empty)
+// is applied to every recipient which has not yet been delivered or bounced
+func (e *Engine) updateStatus(item *QueueItem, override DeliveryStatus) {
+	if e.OutgoingStatusStore == nil {
+		return
+	}
+	status := &MessageStatus{
+		ID:         item.ID,
+		MessageID:  item.Email.MessageID,
+		QueuedAt:   item.QueuedAt,
+		SendAt:     item.Email.SendAt,
+		UpdatedAt:  time.Now(),
+		Recipients: make([]DeliveryResult, len(item.Results)),
+	}
+	copy(status.Recipients, item.Results)
+	for i := range status.Recipients {
+		r := &status.Recipients[i]
+		if override != "" && (r.Status == DeliveryQueued || r.Status == DeliveryDeferred) {
+			r.Status = override
+		}
+	}
+	status.Status = summarizeStatus(status.Recipients)
+	if err := e.OutgoingStatusStore.SetStatus(status); err != nil {
+		e.ErrorLogger(err)
+	}
+}
+
+// Summarize the status of a message using its least progressed recipient,
+// a message is only delivered once all of its recipients have been
+func summarizeStatus(results []DeliveryResult) DeliveryStatus {
+	rank := map[DeliveryStatus]int{
+		DeliverySending:   0,
+		DeliveryQueued:    1,
+		DeliveryDeferred:  2,
+		DeliveryBounced:   3,
+		DeliveryCancelled: 3,
+		DeliveryDelivered: 4,
+	}
+	summary := DeliveryDelivered
+	for _, r := range results {
+		if rank[r.Status] < rank[summary] {
+			summary = r.Status
+		}
+	}
+	return summary
+}
+
+// An in-memory Status Store, statuses are discarded once they
+// have not been updated for longer than the given retention period
+type MemoryStatusStore struct {
+	mu        sync.Mutex
+	retention time.Duration
+	statuses  map[string]*MessageStatus
+	pruned    time.Time
+}
+
+func NewMemoryStatusStore(retention time.Duration) *MemoryStatusStore {
+	return &MemoryStatusStore{
+		retention: retention,
+		statuses:  make(map[string]*MessageStatus),
+		pruned:    time.Now(),
+	}
+}
+
+func (s *MemoryStatusStore) SetStatus(status *MessageStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[status.ID] = status
+
+	// Prune Expired Statuses
+	// 	We only need to do this occasionally so we don't scan on every update
+	now := time.Now()
+	if now.Sub(s.pruned) > s.retention/10 {
+		for id, v := range s.statuses {
+			if now.Sub(v.UpdatedAt) > s.retention {
+				delete(s.statuses, id)
+			}
+		}
+		s.pruned = now
+	}
+	return nil
+}
+
+func (s *MemoryStatusStore) GetStatus(id string) (*MessageStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.statuses[id], nil
+}
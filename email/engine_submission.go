@@ -0,0 +1,322 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/jhillyerd/enmime"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// An account permitted to send emails through the submission listener
+type SubmissionUser struct {
+	Username     string   // Name used to authenticate
+	PasswordHash string   // Hash of the password, either bcrypt or argon2id as returned by HashPassword
+	Addresses    []string // Addresses the user may send as, "@example.org" permits every address on a domain
+}
+
+// Returns true if the user is permitted to send as the given address
+func (u *SubmissionUser) CanSendAs(address string) bool {
+	for _, permitted := range u.Addresses {
+		if domain, ok := strings.CutPrefix(permitted, "@"); ok {
+			if domainOf(address) == strings.ToLower(domain) {
+				return true
+			}
+		} else if address != "" && inboxAddress(address) == inboxAddress(permitted) {
+			return true
+		}
+	}
+	return false
+}
+
+// Storage for the accounts permitted to use the submission listener
+type CredentialStore interface {
+	GetUser(username string) (*SubmissionUser, error) // Returns nil if no user exists with the given username
+}
+
+// An in-memory Credential Store
+type MemoryCredentialStore struct {
+	mu    sync.RWMutex
+	users map[string]*SubmissionUser
+}
+
+func NewMemoryCredentialStore(users ...SubmissionUser) (*MemoryCredentialStore, error) {
+	s := &MemoryCredentialStore{users: make(map[string]*SubmissionUser)}
+	for _, user := range users {
+		if err := s.AddUser(user); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Create or replace a user
+func (s *MemoryCredentialStore) AddUser(user SubmissionUser) error {
+	if user.Username == "" {
+		return fmt.Errorf("user has no username")
+	}
+	if !isPasswordHash(user.PasswordHash) {
+		return fmt.Errorf("password hash for %s is not a bcrypt or argon2id hash", user.Username)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[user.Username] = &user
+	return nil
+}
+
+// Remove a user, returns false if no user exists with the given username
+func (s *MemoryCredentialStore) RemoveUser(username string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.users[username]
+	delete(s.users, username)
+	return ok
+}
+
+func (s *MemoryCredentialStore) GetUser(username string) (*SubmissionUser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.users[username], nil
+}
+
+// Argon2id Parameters (RFC 9106 Section 4)
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// Hash a password with argon2id for use as a SubmissionUser.PasswordHash
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Returns true if the hash is a supported password hash
+func isPasswordHash(hash string) bool {
+	if _, err := bcrypt.Cost([]byte(hash)); err == nil {
+		return true
+	}
+	_, _, _, ok := parseArgon2Hash(hash)
+	return ok
+}
+
+// Parse an argon2id hash in the PHC string format, e.g.
+// "$argon2id$v=19$m=65536,t=3,p=4${salt}${key}"
+func parseArgon2Hash(hash string) (params [3]uint32, salt, key []byte, ok bool) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != fmt.Sprint("v=", argon2.Version) {
+		return params, nil, nil, false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params[0], &params[1], &params[2]); err != nil {
+		return params, nil, nil, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, false
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 || params[2] == 0 || params[2] > 255 {
+		return params, nil, nil, false
+	}
+	return params, salt, key, true
+}
+
+// Returns true if the password matches a bcrypt or argon2id hash
+func CheckPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, ok := parseArgon2Hash(hash)
+		if !ok {
+			return false
+		}
+		derived := argon2.IDKey([]byte(password), salt, params[1], params[0], uint8(params[2]), uint32(len(key)))
+		return subtle.ConstantTimeCompare(derived, key) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// Compared against when a user does not exist, so unknown usernames
+// take as long to reject as incorrect passwords
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, _ := HashPassword("")
+	return hash
+})
+
+var errInvalidCredentials = &smtp.SMTPError{
+	Code:         535,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+	Message:      "Authentication credentials invalid",
+}
+
+// Check the credentials of a user against the credential store
+func (e *Engine) authenticateUser(username, password string) (*SubmissionUser, error) {
+	user, err := e.SubmissionUsers.GetUser(username)
+	if err != nil {
+		e.ErrorLogger(fmt.Errorf("credential store encountered an error: %s", err))
+		return nil, &smtp.SMTPError{
+			Code:         454,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Temporary authentication failure",
+		}
+	}
+	if user == nil {
+		CheckPassword(dummyPasswordHash(), password)
+		return nil, errInvalidCredentials
+	}
+	if !CheckPassword(user.PasswordHash, password) {
+		return nil, errInvalidCredentials
+	}
+	return user, nil
+}
+
+// A server implementation of the LOGIN mechanism, which is obsolete but still
+// preferred by some mail clients. The username may be sent as an initial response.
+type loginServer struct {
+	authenticate func(username, password string) error
+	username     string
+	step         int
+}
+
+func (a *loginServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch a.step {
+	case 0:
+		a.step++
+		if len(response) == 0 {
+			return []byte("Username:"), false, nil
+		}
+		fallthrough
+	case 1:
+		a.step++
+		a.username = string(response)
+		return []byte("Password:"), false, nil
+	default:
+		return nil, true, a.authenticate(a.username, string(response))
+	}
+}
+
+// Queue an email submitted by an authenticated user
+func (e *Engine) submissionHandler(s *Session, r io.Reader) error {
+
+	// Read Submitted Envelope
+	body, err := io.ReadAll(r)
+	if err != nil {
+		e.ErrorLogger(fmt.Errorf("submitted email cannot be read: %s", err))
+		return smtp.ErrDataReset
+	}
+	envelope, err := enmime.ReadEnvelope(bytes.NewReader(body))
+	if err != nil {
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Message is malformed",
+		}
+	}
+	email, err := newEmailFromEnvelope(envelope)
+	if err != nil {
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      fmt.Sprint("Message ", err),
+		}
+	}
+
+	// Validate Sender
+	// 	Users may only send as their own addresses, in the envelope and in the header
+	if !s.user.CanSendAs(email.From.Address) {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("Not permitted to send as %s", email.From.Address),
+		}
+	}
+	if err := e.validateSender(email); err != nil {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("Sender domain is not hosted here: %s", domainOf(email.From.Address)),
+		}
+	}
+
+	// Queue Email
+	// 	The message is relayed as submitted and signed once it is delivered
+	setEnvelopeRecipients(email, s.rcptTo)
+	if email.MessageID == "" {
+		email.MessageID = fmt.Sprint(newQueueID(), "@", e.messageIDDomain(email))
+	}
+	if !e.queueEmail(email, prepareSubmission(body, email.MessageID)) {
+		return &smtp.SMTPError{
+			Code:         452,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+			Message:      "Queue is full, try again later",
+		}
+	}
+	return nil
+}
+
+// Envelope recipients are who the email is delivered to, recipients not
+// named in the To or Cc headers were Bcc'd by the sender
+func setEnvelopeRecipients(email *Email, rcptTo []string) {
+	listed := make(map[string]bool)
+	filter := func(list []Address) []Address {
+		kept := []Address{}
+		for _, a := range list {
+			if slices.ContainsFunc(rcptTo, func(r string) bool { return strings.EqualFold(r, a.Address) }) {
+				listed[strings.ToLower(a.Address)] = true
+				kept = append(kept, a)
+			}
+		}
+		return kept
+	}
+	email.To = filter(email.To)
+	email.Cc = filter(email.Cc)
+	email.Bcc = nil
+	for _, address := range rcptTo {
+		if !listed[strings.ToLower(address)] {
+			email.Bcc = append(email.Bcc, Address{Address: address})
+		}
+	}
+}
+
+// Prepare a submitted message for relay (RFC 6409 Section 8), the Bcc header
+// is removed and a Message-ID and Date are added if the client left them out
+func prepareSubmission(message []byte, messageID string) []byte {
+	fields, body := splitMessage(message)
+	has := func(name string) bool {
+		return slices.ContainsFunc(fields, func(f headerField) bool { return strings.EqualFold(f.name, name) })
+	}
+	var raw bytes.Buffer
+	if !has("Message-ID") {
+		fmt.Fprintf(&raw, "Message-ID: <%s>\r\n", messageID)
+	}
+	if !has("Date") {
+		fmt.Fprintf(&raw, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	}
+	for _, f := range fields {
+		if !strings.EqualFold(f.name, "Bcc") {
+			raw.WriteString(f.raw)
+		}
+	}
+	raw.WriteString("\r\n")
+	raw.Write(body)
+	return raw.Bytes()
+}
@@ -0,0 +1,205 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"maps"
+	"mime"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+)
+
+// A collection of email templates rendered by the engine, loaded from a
+// directory laid out as follows:
+//
+//	layouts/default.html  Layout used by every template (optional)
+//	layouts/{name}.html   Layout used by a specific template instead of the default (optional)
+//	partials/*.html       Templates available to every layout and template (optional)
+//	assets/*              Inline attachments added to every email, referenced as cid:{filename} (optional)
+//	{name}.html           HTML body, overriding blocks of the layout if one is used
+//	{name}.subject        Subject line
+//	{name}.txt            Plain text body (optional)
+//
+// HTML bodies use html/template while subjects and plain text bodies use
+// text/template. Referencing a variable which was not provided is an error.
+type TemplateRegistry struct {
+	mu        sync.RWMutex
+	templates map[string]*emailTemplate
+	assets    []Attachment
+}
+
+type emailTemplate struct {
+	html    *htmltemplate.Template
+	text    *texttemplate.Template
+	subject *texttemplate.Template
+	entry   string // Name of the template to execute for the HTML body
+}
+
+// Load a Template Registry from a directory on disk
+func LoadTemplatesDir(dir string) (*TemplateRegistry, error) {
+	return LoadTemplates(os.DirFS(dir))
+}
+
+// Load a Template Registry from a file system (e.g. an embed.FS)
+func LoadTemplates(fsys fs.FS) (*TemplateRegistry, error) {
+	t := &TemplateRegistry{}
+	if err := t.Reload(fsys); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Replace every template in the registry, the existing templates
+// are kept if any of the new templates cannot be parsed
+func (t *TemplateRegistry) Reload(fsys fs.FS) error {
+
+	// Load Assets
+	assets := []Attachment{}
+	names, _ := fs.Glob(fsys, "assets/*")
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return fmt.Errorf("cannot read template asset: %s", err)
+		}
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		assets = append(assets, Attachment{
+			ContentType: contentType,
+			Filename:    path.Base(name),
+			Data:        data,
+			Inline:      true,
+		})
+	}
+
+	// Load Shared Templates
+	partials, err := readTemplateFiles(fsys, "partials/*.html")
+	if err != nil {
+		return err
+	}
+	layouts, err := readTemplateFiles(fsys, "layouts/*.html")
+	if err != nil {
+		return err
+	}
+
+	// Load Email Templates
+	bodies, err := readTemplateFiles(fsys, "*.html")
+	if err != nil {
+		return err
+	}
+	templates := make(map[string]*emailTemplate, len(bodies))
+	for filename, body := range bodies {
+		name := strings.TrimSuffix(filename, ".html")
+		tmpl := &emailTemplate{entry: filename}
+
+		// Parse HTML Body
+		// 	The layout is parsed first so blocks defined by the body take precedence
+		root := htmltemplate.New("").Option("missingkey=error")
+		layout, ok := layouts["layouts/"+name+".html"]
+		if !ok {
+			layout, ok = layouts["layouts/default.html"]
+		}
+		if ok {
+			if _, err := root.New("layout").Parse(layout); err != nil {
+				return fmt.Errorf("cannot parse layout for template '%s': %s", name, err)
+			}
+			tmpl.entry = "layout"
+		}
+		for _, partial := range slices.Sorted(maps.Keys(partials)) {
+			if _, err := root.New(partial).Parse(partials[partial]); err != nil {
+				return fmt.Errorf("cannot parse partial '%s': %s", partial, err)
+			}
+		}
+		if _, err := root.New(filename).Parse(body); err != nil {
+			return fmt.Errorf("cannot parse template '%s': %s", name, err)
+		}
+		tmpl.html = root
+
+		// Parse Subject
+		subject, err := fs.ReadFile(fsys, name+".subject")
+		if err != nil {
+			return fmt.Errorf("cannot read subject for template '%s': %s", name, err)
+		}
+		tmpl.subject, err = texttemplate.New(name).Option("missingkey=error").Parse(strings.TrimSpace(string(subject)))
+		if err != nil {
+			return fmt.Errorf("cannot parse subject for template '%s': %s", name, err)
+		}
+
+		// Parse Plain Text Body
+		if text, err := fs.ReadFile(fsys, name+".txt"); err == nil {
+			tmpl.text, err = texttemplate.New(name).Option("missingkey=error").Parse(string(text))
+			if err != nil {
+				return fmt.Errorf("cannot parse text for template '%s': %s", name, err)
+			}
+		}
+		templates[name] = tmpl
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.templates, t.assets = templates, assets
+	return nil
+}
+
+// Read every file matching a pattern, keyed by their path
+func readTemplateFiles(fsys fs.FS, pattern string) (map[string]string, error) {
+	files := make(map[string]string)
+	names, err := fs.Glob(fsys, pattern)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read template: %s", err)
+		}
+		files[name] = string(b)
+	}
+	return files, nil
+}
+
+// Returns the names of every template in the registry
+func (t *TemplateRegistry) Names() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return slices.Sorted(maps.Keys(t.templates))
+}
+
+// Render a template with the given variables, returning an email with its
+// subject, bodies and inline assets set. The sender and recipients are left
+// for the caller to fill in.
+func (t *TemplateRegistry) Render(name string, vars map[string]any) (*Email, error) {
+	t.mu.RLock()
+	tmpl, ok := t.templates[name]
+	assets := t.assets
+	t.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("template does not exist: %s", name)
+	}
+
+	var subject, html, text bytes.Buffer
+	if err := tmpl.subject.Execute(&subject, vars); err != nil {
+		return nil, fmt.Errorf("cannot render subject: %s", err)
+	}
+	if err := tmpl.html.ExecuteTemplate(&html, tmpl.entry, vars); err != nil {
+		return nil, fmt.Errorf("cannot render html: %s", err)
+	}
+	if tmpl.text != nil {
+		if err := tmpl.text.Execute(&text, vars); err != nil {
+			return nil, fmt.Errorf("cannot render text: %s", err)
+		}
+	}
+	return &Email{
+		Subject:     strings.Join(strings.Fields(subject.String()), " "),
+		HTMLBody:    html.String(),
+		Text:        text.String(),
+		Attachments: slices.Clone(assets),
+	}, nil
+}
@@ -0,0 +1,268 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Determines how STARTTLS is used when delivering to a mail exchanger
+type TLSPolicy int
+
+const (
+	TLSOpportunistic       TLSPolicy = iota // Use STARTTLS when offered without verifying certificates, falling back to plaintext if it fails
+	TLSOpportunisticVerify                  // Use STARTTLS when offered, deferring delivery if the certificate cannot be verified
+	TLSRequired                             // Defer delivery unless STARTTLS is offered and the certificate can be verified
+	TLSDisabled                             // Never use STARTTLS
+)
+
+// An open SMTP connection to a mail exchanger
+type outgoingSession struct {
+	host   string
+	conn   net.Conn
+	client *smtp.Client
+	tls    bool
+}
+
+// Connect to a mail exchanger, introducing ourselves as Engine.Domain and
+// upgrading the connection according to OutgoingTLSPolicy
+func (e *Engine) dialSession(ctx context.Context, host string) (*outgoingSession, error) {
+	policy := e.OutgoingTLSPolicy
+	s, err := e.connect(ctx, host, e.OutgoingPort, policy, false, e.OutgoingTLSConfig)
+	if err != nil && policy == TLSOpportunistic && errors.Is(err, errHandshake) {
+		// The handshake leaves the connection in an unusable state
+		// so we need to start over again without encryption
+		return e.connect(ctx, host, e.OutgoingPort, TLSDisabled, false, e.OutgoingTLSConfig)
+	}
+	return s, err
+}
+
+var errHandshake = errors.New("tls handshake failed")
+
+// Open an SMTP session, either upgrading with STARTTLS according to the
+// given policy or by negotiating TLS immediately if implicitTLS is set
+func (e *Engine) connect(ctx context.Context, host string, port int, policy TLSPolicy, implicitTLS bool, tlsConfig *tls.Config) (*outgoingSession, error) {
+	serverName := strings.TrimSuffix(host, ".")
+	conn, err := e.OutgoingDialer(ctx, "tcp", net.JoinHostPort(serverName, fmt.Sprint(port)))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	s := &outgoingSession{host: host, conn: conn}
+	config := &tls.Config{}
+	if tlsConfig != nil {
+		config = tlsConfig.Clone()
+	}
+	config.ServerName = serverName
+	config.InsecureSkipVerify = config.InsecureSkipVerify || policy == TLSOpportunistic
+
+	// Implicit TLS
+	if implicitTLS {
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%w: %s", errHandshake, err)
+		}
+		s.conn, s.tls = tlsConn, true
+		s.client = smtp.NewClient(tlsConn)
+		s.client.CommandTimeout = e.OutgoingTimeout
+		s.client.SubmissionTimeout = e.OutgoingTimeout
+		if err := s.client.Hello(e.Domain); err != nil {
+			s.client.Close()
+			return nil, err
+		}
+		return s, nil
+	}
+
+	// Negotiate STARTTLS
+	// 	The go-smtp client does not expose STARTTLS after a custom EHLO, so we
+	// 	perform the greeting ourselves and hand over the (upgraded) connection
+	text := textproto.NewConn(conn)
+	greeting, err := readReply(text, 220)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := text.PrintfLine("EHLO %s", e.Domain); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	extensions, err := readReply(text, 250)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	offered := false
+	for _, line := range strings.Split(extensions, "\n") {
+		if strings.EqualFold(strings.TrimSpace(line), "STARTTLS") {
+			offered = true
+		}
+	}
+	switch {
+	case policy == TLSDisabled:
+	case !offered && policy == TLSRequired:
+		conn.Close()
+		return nil, &smtp.SMTPError{
+			Code:         421,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 10},
+			Message:      "STARTTLS is required but was not offered",
+		}
+	case offered:
+		if err := text.PrintfLine("STARTTLS"); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if _, err := readReply(text, 220); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%w: %s", errHandshake, err)
+		}
+		conn, s.tls = tlsConn, true
+	}
+
+	// Start Client
+	// 	The greeting is replayed so the client believes it's a fresh connection,
+	// 	it will then introduce itself again which is permitted by RFC 5321
+	s.conn = conn
+	s.client = smtp.NewClient(&greetedConn{
+		Conn:     conn,
+		greeting: strings.NewReader(fmt.Sprintf("220 %s\r\n", strings.ReplaceAll(greeting, "\n", " "))),
+	})
+	s.client.CommandTimeout = e.OutgoingTimeout
+	s.client.SubmissionTimeout = e.OutgoingTimeout
+	if err := s.client.Hello(e.Domain); err != nil {
+		s.client.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Perform a mail transaction, returning the final reply from the server and
+// the outcome for each recipient (nil if accepted). The error is only set if
+// the transaction failed as a whole.
+func (s *outgoingSession) send(ctx context.Context, sender string, recipients []string, message []byte) (string, []error, error) {
+	stop := context.AfterFunc(ctx, func() {
+		// Abort anything still in progress once the deadline is exceeded
+		s.conn.Close()
+	})
+	defer stop()
+
+	rcptErrors := make([]error, len(recipients))
+	if err := s.client.Mail(sender, nil); err != nil {
+		return "", rcptErrors, err
+	}
+	accepted := 0
+	for i, rcpt := range recipients {
+		if err := s.client.Rcpt(rcpt, nil); err != nil {
+			rcptErrors[i] = err
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		// Nothing to send, reset the transaction so the session can be reused
+		s.client.Reset()
+		return "", rcptErrors, nil
+	}
+	w, err := s.client.Data()
+	if err != nil {
+		return "", rcptErrors, err
+	}
+	if _, err := io.Copy(w, bytes.NewReader(message)); err != nil {
+		w.Close()
+		return "", rcptErrors, err
+	}
+	response, err := w.CloseWithResponse()
+	if err != nil {
+		return "", rcptErrors, err
+	}
+	return response.StatusText, rcptErrors, nil
+}
+
+// Politely end the session
+func (s *outgoingSession) close() {
+	s.client.Quit()
+	s.client.Close()
+}
+
+// Read a (possibly multiline) reply, returning an *smtp.SMTPError if the
+// code does not match the expected code
+func readReply(text *textproto.Conn, expectCode int) (string, error) {
+	code, message, err := text.ReadResponse(expectCode)
+	if err != nil {
+		var te *textproto.Error
+		if errors.As(err, &te) {
+			return "", &smtp.SMTPError{Code: code, EnhancedCode: smtp.NoEnhancedCode, Message: message}
+		}
+		return "", err
+	}
+	return message, nil
+}
+
+// A connection which replays a greeting before reading from the underlying connection
+type greetedConn struct {
+	net.Conn
+	greeting io.Reader
+}
+
+func (g *greetedConn) Read(b []byte) (int, error) {
+	if g.greeting != nil {
+		n, err := g.greeting.Read(b)
+		if err != io.EOF {
+			return n, err
+		}
+		g.greeting = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return g.Conn.Read(b)
+}
+
+// Record the reply to a failed SMTP command on a Delivery Result,
+// returning true if the failure is permanent
+func applyReply(r *DeliveryResult, err error) bool {
+	var se *smtp.SMTPError
+	if errors.As(err, &se) {
+		r.Code, r.EnhancedCode, r.Message = se.Code, formatEnhancedCode(se.EnhancedCode), se.Message
+		return se.Code >= 500
+	}
+	r.Code, r.EnhancedCode, r.Message = 0, "", err.Error()
+	return false
+}
+
+func formatEnhancedCode(c smtp.EnhancedCode) string {
+	if c[0] <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d.%d", c[0], c[1], c[2])
+}
+
+// Separate a leading enhanced status code (e.g. "2.0.0 OK") from a reply
+func splitEnhancedCode(reply string) (string, string) {
+	code, message, _ := strings.Cut(reply, " ")
+	parts := strings.Split(code, ".")
+	if len(parts) != 3 {
+		return "", reply
+	}
+	for _, p := range parts {
+		if p == "" || strings.Trim(p, "0123456789") != "" {
+			return "", reply
+		}
+	}
+	return code, message
+}
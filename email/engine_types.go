@@ -1,5 +1,23 @@
 package email
 
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// Delivery Status of a single recipient
+type DeliveryStatus string
+
+const (
+	DeliveryQueued    DeliveryStatus = "queued"    // Waiting for the first attempt
+	DeliverySending   DeliveryStatus = "sending"   // Currently being attempted by a worker
+	DeliveryDeferred  DeliveryStatus = "deferred"  // Temporarily failed, will be retried
+	DeliveryDelivered DeliveryStatus = "delivered" // Accepted by the receiving server
+	DeliveryBounced   DeliveryStatus = "bounced"   // Permanently failed, will not be retried
+	DeliveryCancelled DeliveryStatus = "cancelled" // Removed from the queue before it could be delivered
+)
+
 type Address struct {
 	Name    string `validate:"required,min=1,max=128" json:"name"`
 	Address string `validate:"required,email,max=128" json:"address"`
@@ -13,10 +31,116 @@ type Attachment struct {
 }
 
 type Email struct {
-	To          []Address    `validate:"required,dive" json:"to"`
-	From        Address      `validate:"required" json:"from"`
-	Subject     string       `validate:"required" json:"subject"`
-	Content     string       `validate:"required" json:"content"`
-	HTML        bool         `validate:"required" json:"html"`
-	Attachments []Attachment `validate:"dive" json:"attachments"`
+	ID          string            `validate:"omitempty,max=64" json:"id,omitempty"`
+	MessageID   string            `validate:"omitempty,max=255" json:"message_id,omitempty"`
+	InReplyTo   string            `validate:"omitempty,max=255" json:"in_reply_to,omitempty"`
+	References  []string          `validate:"omitempty,max=64,dive,max=255" json:"references,omitempty"`
+	To          []Address         `validate:"required,dive" json:"to"`
+	Cc          []Address         `validate:"omitempty,dive" json:"cc,omitempty"`
+	Bcc         []Address         `validate:"omitempty,dive" json:"bcc,omitempty"`
+	From        Address           `validate:"required" json:"from"`
+	ReplyTo     *Address          `validate:"omitempty" json:"reply_to,omitempty"`
+	Headers     map[string]string `validate:"omitempty,max=64" json:"headers,omitempty"`
+	Subject     string            `validate:"required" json:"subject"`
+	Content     string            `validate:"required_without_all=Text HTMLBody" json:"content,omitempty"`
+	HTML        bool              `json:"html"`
+	Text        string            `json:"text,omitempty"`
+	HTMLBody    string            `json:"html_body,omitempty"`
+	Attachments []Attachment      `validate:"dive" json:"attachments"`
+	SendAt      time.Time         `json:"send_at,omitzero"`
+	MailFrom    string            `json:"-"` // Envelope sender (MAIL FROM) of Incoming Emails, empty for bounces
+	RcptTo      []string          `json:"-"` // Envelope recipients (RCPT TO) of Incoming Emails, which may differ from To and Cc
+	Auth        *AuthResults      `json:"-"` // Authentication checks performed on Incoming Emails, kept by the queue when they are forwarded
+	Raw         []byte            `json:"-"` // Original message of Incoming Emails, prefixed with our Authentication-Results header if received over SMTP
+}
+
+// Returns the plain text and HTML bodies of the email, Content is used
+// for whichever body is missing depending on the value of HTML
+func (email *Email) Bodies() (text string, html string) {
+	text, html = email.Text, email.HTMLBody
+	switch {
+	case email.Content == "":
+	case email.HTML && html == "":
+		html = email.Content
+	case !email.HTML && text == "":
+		text = email.Content
+	}
+	return text, html
+}
+
+// Create a reply to the email from the given address, threaded using the
+// In-Reply-To and References headers. The reply is addressed to the Reply-To
+// address if one is set and only needs a body before it can be queued.
+func (email *Email) Reply(from Address) *Email {
+	to := email.From
+	if email.ReplyTo != nil {
+		to = *email.ReplyTo
+	}
+	subject := email.Subject
+	if len(subject) < 3 || !strings.EqualFold(subject[:3], "re:") {
+		subject = "Re: " + subject
+	}
+
+	// Without References the parent's In-Reply-To is used instead (RFC 5322 section 3.6.4)
+	references := slices.Clone(email.References)
+	if len(references) == 0 && email.InReplyTo != "" {
+		references = []string{email.InReplyTo}
+	}
+	if email.MessageID != "" {
+		references = append(references, email.MessageID)
+	}
+	return &Email{
+		To:         []Address{to},
+		From:       from,
+		Subject:    subject,
+		InReplyTo:  email.MessageID,
+		References: references,
+	}
+}
+
+// Returns true if the email was sent automatically according to its
+// Auto-Submitted header (RFC 3834), such as bounces and auto replies
+func (email *Email) AutoSubmitted() bool {
+	for name, value := range email.Headers {
+		if strings.EqualFold(name, "Auto-Submitted") && isAutoSubmitted(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true for any Auto-Submitted value other than "no", ignoring parameters
+func isAutoSubmitted(value string) bool {
+	keyword, _, _ := strings.Cut(value, ";")
+	keyword = strings.ToLower(strings.TrimSpace(keyword))
+	return keyword != "" && keyword != "no"
+}
+
+// Returns every recipient of the email, To then Cc then Bcc, without duplicates
+func (email *Email) Recipients() []Address {
+	seen := make(map[string]bool)
+	recipients := make([]Address, 0, len(email.To)+len(email.Cc)+len(email.Bcc))
+	for _, list := range [][]Address{email.To, email.Cc, email.Bcc} {
+		for _, a := range list {
+			key := strings.ToLower(a.Address)
+			if !seen[key] {
+				seen[key] = true
+				recipients = append(recipients, a)
+			}
+		}
+	}
+	return recipients
+}
+
+// Outcome of delivering an outgoing email to a single recipient
+type DeliveryResult struct {
+	Recipient    string         `json:"recipient"`
+	Status       DeliveryStatus `json:"status"`
+	Host         string         `json:"host"`
+	Code         int            `json:"code"`
+	EnhancedCode string         `json:"enhanced_code"`
+	Message      string         `json:"message"`
+	Attempts     int            `json:"attempts"`
+	FirstAttempt time.Time      `json:"first_attempt"`
+	LastAttempt  time.Time      `json:"last_attempt"`
 }
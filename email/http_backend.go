@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 )
@@ -16,71 +18,218 @@ func newHttpHandler(e *Engine) *http.ServeMux {
 	r := http.NewServeMux()
 	r.HandleFunc("/queue", func(w http.ResponseWriter, r *http.Request) {
 
-		// Sanity Checks
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+		// Parse Request Body
+		var incoming []Email
+		if !decodeBody(e, w, r, &incoming) {
 			return
 		}
-		if r.Header.Get("Content-Type") != "application/json" {
-			w.WriteHeader(http.StatusUnsupportedMediaType)
+
+		// Validate Incoming Emails
+		// 	Every email is validated before queueing so a single bad
+		// 	email doesn't leave the batch partially queued
+		failures := []string{}
+		emails := make([]*Email, len(incoming))
+		for i := range incoming {
+			emails[i] = &incoming[i]
+			err := v.Struct(incoming[i])
+			if err == nil {
+				err = validateHeaders(incoming[i].Headers)
+			}
+			if err == nil {
+				err = e.validateSender(&incoming[i])
+			}
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("Validation Failed for Email at Index %d: %s\n", i, err))
+			}
+		}
+		if len(failures) > 0 {
+			e.ErrorLogger(fmt.Errorf("validation failed for %d email(s)", len(failures)))
+			http.Error(w, strings.Join(failures, ""), http.StatusBadRequest)
 			return
 		}
-		if r.ContentLength > e.IncomingMaxBytes {
-			w.WriteHeader(http.StatusRequestEntityTooLarge)
+
+		// Queue Incoming Emails
+		queueEmails(e, w, emails)
+	})
+	r.HandleFunc("/send-template", func(w http.ResponseWriter, r *http.Request) {
+
+		// Parse Request Body
+		var incoming templateRequest
+		if !decodeBody(e, w, r, &incoming) {
 			return
 		}
-		if !e.AuthHandler(r) {
-			w.WriteHeader(http.StatusUnauthorized)
+		if e.Templates == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := v.Struct(incoming); err != nil {
+			http.Error(w, fmt.Sprintf("Validation Failed: %s\n", err), http.StatusBadRequest)
+			return
+		}
+		if err := e.validateSender(&Email{From: incoming.From}); err != nil {
+			http.Error(w, fmt.Sprintf("Validation Failed: %s\n", err), http.StatusBadRequest)
 			return
 		}
 
-		// Parse Request Body
-		var incoming []Email
-		var incomingBody io.Reader
-		var consumedBody = http.MaxBytesReader(w, r.Body, e.IncomingMaxBytes)
-
-		switch strings.ToLower(r.Header.Get("Content-Encoding")) {
-		case "gzip":
-			gr, err := gzip.NewReader(consumedBody)
+		// Render Emails
+		// 	Every recipient is rendered before queueing so a single bad
+		// 	recipient doesn't leave the batch partially queued
+		rendered := make([]*Email, 0, len(incoming.Recipients))
+		for i, recipient := range incoming.Recipients {
+			vars := make(map[string]any, len(incoming.Vars)+len(recipient.Vars))
+			maps.Copy(vars, incoming.Vars)
+			maps.Copy(vars, recipient.Vars)
+			em, err := e.Templates.Render(incoming.Template, vars)
 			if err != nil {
-				// Errors only arise from invalid gzip headers so this is
-				// definitely the users fault
-				w.WriteHeader(http.StatusBadRequest)
+				http.Error(w, fmt.Sprintf("Render Failed for Recipient at Index %d: %s\n", i, err), http.StatusBadRequest)
 				return
 			}
-			defer gr.Close()
-			incomingBody = gr
+			em.From = incoming.From
+			em.ReplyTo = incoming.ReplyTo
+			em.To = []Address{recipient.To}
+			em.SendAt = incoming.SendAt
+			rendered = append(rendered, em)
+		}
 
-		case "": // No Compression
-			incomingBody = consumedBody
+		// Queue Rendered Emails
+		queueEmails(e, w, rendered)
+	})
+	r.HandleFunc("/messages/{id}", func(w http.ResponseWriter, r *http.Request) {
 
-		default:
-			w.WriteHeader(http.StatusUnsupportedMediaType)
+		// Sanity Checks
+		if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
-		decoder := json.NewDecoder(incomingBody)
-		decoder.DisallowUnknownFields()
-		if err := decoder.Decode(&incoming); err != nil {
-			e.ErrorLogger(fmt.Errorf("error parsing body: %s", err))
-			http.Error(w, "Invalid Form Body", http.StatusUnprocessableEntity)
+		if !e.AuthHandler(r) {
+			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		// Queue Incoming Emails
-		for i := range incoming {
-			if err := v.Struct(incoming[i]); err != nil {
-				e.ErrorLogger(fmt.Errorf("validation failed for email at index %d: %s", i, err))
-				http.Error(w, fmt.Sprintf("Validation Failed for Email at Index %d: %s\n", i, err), http.StatusBadRequest)
-				continue
-			}
-			if ok := e.QueueEmail(&incoming[i]); !ok {
-				http.Error(w, fmt.Sprintf("Email queue is full at index: %d\n", i), http.StatusInsufficientStorage)
-				continue
+		// Cancel Queued Message
+		if r.Method == http.MethodDelete {
+			if !e.CancelEmail(r.PathValue("id")) {
+				w.WriteHeader(http.StatusNotFound)
+				return
 			}
+			w.WriteHeader(http.StatusNoContent)
+			return
 		}
 
-		// Success!
-		w.WriteHeader(http.StatusCreated)
+		// Lookup Message Status
+		if e.OutgoingStatusStore == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		status, err := e.OutgoingStatusStore.GetStatus(r.PathValue("id"))
+		if err != nil {
+			e.ErrorLogger(fmt.Errorf("error fetching message status: %s", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if status == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
 	})
 	return r
 }
+
+// Perform the sanity checks shared by endpoints accepting a JSON body and
+// decode it into v, returns false if a response has already been written
+func decodeBody(e *Engine, w http.ResponseWriter, r *http.Request, v any) bool {
+
+	// Sanity Checks
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return false
+	}
+	if r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return false
+	}
+	if r.ContentLength > e.IncomingMaxBytes {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if !e.AuthHandler(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	// Parse Request Body
+	var incomingBody io.Reader
+	var consumedBody = http.MaxBytesReader(w, r.Body, e.IncomingMaxBytes)
+
+	switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+	case "gzip":
+		gr, err := gzip.NewReader(consumedBody)
+		if err != nil {
+			// Errors only arise from invalid gzip headers so this is
+			// definitely the users fault
+			w.WriteHeader(http.StatusBadRequest)
+			return false
+		}
+		defer gr.Close()
+		incomingBody = gr
+
+	case "": // No Compression
+		incomingBody = consumedBody
+
+	default:
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return false
+	}
+	decoder := json.NewDecoder(incomingBody)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		e.ErrorLogger(fmt.Errorf("error parsing body: %s", err))
+		http.Error(w, "Invalid Form Body", http.StatusUnprocessableEntity)
+		return false
+	}
+	return true
+}
+
+type templateRequest struct {
+	Template   string              `json:"template" validate:"required"`
+	From       Address             `json:"from" validate:"required"`
+	ReplyTo    *Address            `json:"reply_to,omitempty"`
+	SendAt     time.Time           `json:"send_at,omitzero"`
+	Vars       map[string]any      `json:"vars,omitempty"`
+	Recipients []templateRecipient `json:"recipients" validate:"required,min=1,dive"`
+}
+
+type templateRecipient struct {
+	To   Address        `json:"to" validate:"required"`
+	Vars map[string]any `json:"vars,omitempty"`
+}
+
+type queueResponse struct {
+	ID        string `json:"id,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Queue validated emails and respond with the result for each of them. Every
+// email is attempted even if the queue fills up part way through, so clients
+// know which emails were queued and only need to retry the ones which weren't.
+func queueEmails(e *Engine, w http.ResponseWriter, emails []*Email) {
+	code := http.StatusCreated
+	queued := make([]queueResponse, len(emails))
+	for i, em := range emails {
+		if !e.QueueEmail(em) {
+			code = http.StatusInsufficientStorage
+			queued[i].Error = "Email queue is full or the email could not be persisted"
+			continue
+		}
+		queued[i] = queueResponse{ID: em.ID, MessageID: em.MessageID}
+	}
+	writeJSON(w, code, queued)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,75 @@
+package email
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestHTTPEngine(t *testing.T) *Engine {
+	e := New("example.com")
+	e.OutgoingQueuePath = filepath.Join(t.TempDir(), "outgoing.wal")
+	e.AuthHandler = func(r *http.Request) bool { return true }
+	e.ErrorLogger = func(err error) {}
+	t.Cleanup(func() {
+		if e.OutgoingQueueStore != nil {
+			e.OutgoingQueueStore.Close()
+		}
+	})
+	return &e
+}
+
+func postJSON(e *Engine, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	newHttpHandler(e).ServeHTTP(w, r)
+	return w
+}
+
+const testQueueEmail = `{"to":[{"name":"Bob","address":"bob@example.net"}],"from":{"name":"Alice","address":"alice@example.com"},"subject":"Hello","content":"Hello World!"}`
+
+func TestHTTPQueueValidation(t *testing.T) {
+	e := newTestHTTPEngine(t)
+	invalid := `{"to":[{"name":"Bob","address":"bob@example.net"}],"from":{"name":"Alice","address":"alice@example.org"},"subject":"Hello","content":"Hello World!"}`
+	w := postJSON(e, "/queue", "["+testQueueEmail+","+invalid+","+invalid+"]")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "Index 1") || !strings.Contains(body, "Index 2") {
+		t.Errorf("response does not list every failure: %q", body)
+	}
+	if n := e.outgoingQueue.len(); n != 0 {
+		t.Errorf("got %d queued emails, want none", n)
+	}
+}
+
+func TestHTTPQueuePartial(t *testing.T) {
+	e := newTestHTTPEngine(t)
+	e.OutgoingQueueSize = 2
+	w := postJSON(e, "/queue", "["+testQueueEmail+","+testQueueEmail+","+testQueueEmail+"]")
+	if w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("got %d, want %d: %s", w.Code, http.StatusInsufficientStorage, w.Body)
+	}
+	var results []queueResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("response is not a result array: %s", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	for i, r := range results[:2] {
+		if r.ID == "" || r.Error != "" {
+			t.Errorf("email %d was not queued: %+v", i, r)
+		}
+	}
+	if results[2].ID != "" || results[2].Error == "" {
+		t.Errorf("email 2 should have failed: %+v", results[2])
+	}
+	if n := e.outgoingQueue.len(); n != 2 {
+		t.Errorf("got %d queued emails, want 2", n)
+	}
+}
@@ -1,7 +1,11 @@
 package email
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"net"
+	"strings"
 
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
@@ -10,31 +14,111 @@ import (
 // todo: comment
 
 type Backend struct {
-	engine *Engine
+	engine     *Engine
+	submission bool // Sessions submit outgoing emails rather than receive incoming ones
 }
 type Session struct {
-	engine *Engine
+	engine     *Engine
+	conn       *smtp.Conn
+	submission bool            // Session is on the submission listener
+	user       *SubmissionUser // Authenticated user, submission only
+	clientIP   net.IP          // Address of the connecting client
+	mailFrom   string          // Envelope sender of the current transaction
+	rcptTo     []string        // Envelope recipients of the current transaction
+	spf        *SPFCheck       // SPF result for the current transaction
 }
 
 func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	return &Session{engine: b.engine}, nil
+	s := &Session{engine: b.engine, conn: c, submission: b.submission}
+	if addr, ok := c.Conn().RemoteAddr().(*net.TCPAddr); ok {
+		s.clientIP = addr.IP
+	}
+	return s, nil
 }
 func (s *Session) AuthMechanisms() []string {
-	return []string{}
+	if !s.submission {
+		return []string{}
+	}
+	return []string{sasl.Plain, sasl.Login}
 }
 func (s *Session) Auth(mech string) (sasl.Server, error) {
-	return nil, smtp.ErrAuthUnsupported
+	if !s.submission {
+		return nil, smtp.ErrAuthUnsupported
+	}
+	login := func(username, password string) error {
+		user, err := s.engine.authenticateUser(username, password)
+		if err != nil {
+			return err
+		}
+		s.user = user
+		return nil
+	}
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			if identity != "" && identity != username {
+				return errInvalidCredentials
+			}
+			return login(username, password)
+		}), nil
+	case sasl.Login:
+		return &loginServer{authenticate: login}, nil
+	}
+	return nil, smtp.ErrAuthUnknownMechanism
+}
+func (s *Session) Reset() {
+	s.mailFrom = ""
+	s.rcptTo = nil
+	s.spf = nil
 }
-func (s *Session) Reset() {}
 func (s *Session) Logout() error {
 	return nil
 }
 func (s *Session) Mail(fromAddress string, opts *smtp.MailOptions) error {
+	if s.submission {
+		if s.user == nil {
+			return smtp.ErrAuthRequired
+		}
+		if !s.user.CanSendAs(fromAddress) {
+			return &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      fmt.Sprintf("Not permitted to send as %s", fromAddress),
+			}
+		}
+		s.mailFrom = fromAddress
+		return nil
+	}
+	s.mailFrom = fromAddress
+
+	// Check Sender Policy
+	if s.engine.IncomingValidateSPF && s.clientIP != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), s.engine.IncomingTimeout)
+		defer cancel()
+		s.spf = s.engine.checkSPF(ctx, s.clientIP, s.conn.Hostname(), fromAddress)
+		if err := s.engine.spfError(s.spf); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 func (s *Session) Rcpt(toAddress string, opts *smtp.RcptOptions) error {
+	if !s.submission {
+		if err := s.engine.checkRecipient(toAddress); err != nil {
+			return err
+		}
+	}
+	for _, address := range s.rcptTo {
+		if strings.EqualFold(address, toAddress) {
+			return nil
+		}
+	}
+	s.rcptTo = append(s.rcptTo, toAddress)
 	return nil
 }
 func (s *Session) Data(r io.Reader) error {
-	return s.engine.incomingHandler(r)
+	if s.submission {
+		return s.engine.submissionHandler(s, r)
+	}
+	return s.engine.incomingHandler(s, r)
 }
@@ -39,6 +39,8 @@ func main() {
 
 	// You application would then query some data and execute a template
 	// sending the rendered output to the engines REST API
+	// 	Alternatively the templates can live on the server and be rendered
+	// 	by the engine itself, see POST /send-template in the API docs.
 	outboundAddress := SMTP_DESTINATION
 	outboundLocals := LocalsForgotPassword{
 		Displayname: "Example User",
@@ -27,6 +27,8 @@ var (
 	PATH_TLS_KEY = envString("PATH_TLS_KEY", "tls_key.pem")
 	PATH_TLS_CRT = envString("PATH_TLS_CRT", "tls_crt.pem")
 	PATH_TLS_CA  = envString("PATH_TLS_CA", "tls_ca.pem")
+	PATH_QUEUE   = envString("PATH_QUEUE", "outgoing.wal")
+	PATH_TMPL    = envString("PATH_TMPL", "templates")
 	SMTP_DOMAIN  = envString("SMTP_DOMAIN", "example.org")
 	SMTP_ADDRESS = envString("SMTP_ADDRESS", "0.0.0.0:25")
 	HTTP_ADDRESS = envString("HTTP_ADDRESS", "0.0.0.0:80")
@@ -46,6 +48,10 @@ func main() {
 	// 	for our example, but could harshly affect performance in a production environment.
 	e.ErrorLogger = email.DefaultErrorLogger
 
+	// Queued emails are written to a log on disk before being accepted, any emails
+	// which were not sent before a restart will be sent again once the server starts.
+	e.OutgoingQueuePath = PATH_QUEUE
+
 	// By default the Auth Handler only allow requests from a loopback address
 	// You can implement your own authorization handler, below are a few examples you can implement,
 	// but for this example server we'll be accepting all incoming requests.
@@ -65,31 +71,40 @@ func main() {
 		return true
 	}
 
-	// In the case an email comes in with no valid recipient we can write a function to log the email.
-	// 	Please note that the SMTP Server will still respond with a '550 Invalid Recipient'
-	// 	error and this behaviour cannot be modified.
+	// Emails to recipients without an inbox are rejected before the sender transmits any data.
+	// 	A Recipient Validator can accept extra addresses such as a catch-all, those emails are then
+	// 	given to the No Inbox Handler. Returning an error asks the sender to try again later.
+	// 	Emails are routed by their envelope recipients (RcptTo) which may not appear in the To header.
+	e.RecipientValidator = func(address string) (bool, error) {
+		// Example: Catch-all for addresses like 'support+ticket123@{{DOMAIN}}'
+		return strings.HasPrefix(address, "support+") && strings.HasSuffix(address, "@"+e.Domain), nil
+	}
 	e.NoInboxHandler = func(e *email.Email) error {
-		log.Printf("No Inbox for To=%v, Subject=%q, From=%q\n", e.To, e.Subject, e.From)
+		log.Printf("No Inbox for RcptTo=%v, To=%v, Subject=%q, From=%q\n", e.RcptTo, e.To, e.Subject, e.From)
 		return nil
 	}
 
 	// Registering Inboxes
 	// 	Our application sends out emails as 'noreply@{{DOMAIN}}' in the case our user
 	// 	accidentally send an email to our noreply inbox we can reply with a friendly message!
+	// 	Using Reply keeps our response in the same thread as their email in most clients.
+	// 	Bounces (which have no envelope sender) and other automatic emails are never replied to,
+	// 	otherwise two auto responders could keep replying to each other forever (RFC 3834).
 	e.RegisterInbox("noreply", func(em *email.Email) error {
-		e.QueueEmail(&email.Email{
-			To:      []email.Address{{Name: em.From.Name, Address: em.From.Address}},
-			From:    email.Address{Name: "Example Inc.", Address: "noreply@" + e.Domain},
-			Subject: "beep boop (Need Help?)",
-			Content: noReplyIndex,
-			HTML:    true,
-			Attachments: []email.Attachment{{
-				ContentType: "image/png",
-				Filename:    "robot.png",
-				Data:        noReplyImage,
-				Inline:      true,
-			}},
-		})
+		if em.MailFrom == "" || em.AutoSubmitted() {
+			return nil
+		}
+		reply := em.Reply(email.Address{Name: "Example Inc.", Address: "noreply@" + e.Domain})
+		reply.Headers = map[string]string{"Auto-Submitted": "auto-replied"}
+		reply.Subject = "beep boop (Need Help?)"
+		reply.HTMLBody = noReplyIndex
+		reply.Attachments = []email.Attachment{{
+			ContentType: "image/png",
+			Filename:    "robot.png",
+			Data:        noReplyImage,
+			Inline:      true,
+		}}
+		e.QueueEmail(reply)
 		return nil
 	})
 
@@ -108,12 +123,125 @@ func main() {
 		log.Println("Incoming Email from", em.From.Address)
 		return true, nil
 	})
+	// Example: Drop Emails which failed SPF softly
+	// 	Senders failing their SPF policy outright are already rejected before they send any data,
+	// 	the actions taken for each result can be changed with IncomingSPFActions.
+	e.UseIncoming(func(em *email.Email) (bool, error) {
+		return em.Auth.SPF == nil || em.Auth.SPF.Result != email.SPFSoftFail, nil
+	})
+	// Example: Quarantine Emails according to DMARC
+	// 	Emails the sender's policy asks us to reject never reach middleware, but quarantined ones do.
+	e.UseIncoming(func(em *email.Email) (bool, error) {
+		if em.Auth.DMARC != nil && em.Auth.DMARC.Disposition == email.DMARCPolicyQuarantine {
+			em.Subject = "[SPAM] " + em.Subject
+		}
+		return true, nil
+	})
 	// Example: Basic Outbound Email Logger
 	e.UseOutgoing(func(em *email.Email) (bool, error) {
 		log.Println("Sending Email with Subject", em.Subject)
 		return true, nil
 	})
 
+	// Tracking Deliveries
+	// 	After each attempt at sending a queued email we receive the result for every recipient,
+	// 	recipients which were deferred will be retried automatically until they expire.
+	e.DeliveryHandler = func(em *email.Email, results []email.DeliveryResult) {
+		for _, r := range results {
+			log.Printf("Delivery to %s via %q: %s (%d %s)\n", r.Recipient, r.Host, r.Status, r.Code, r.Message)
+		}
+	}
+
+	// Bounces
+	// 	When an email fails permanently a delivery status notification is sent back to the original
+	// 	sender, we can additionally warn them when an email has been stuck in the queue for a while.
+	e.OutgoingDelayNotify = []time.Duration{4 * time.Hour, 24 * time.Hour}
+
+	// Relaying
+	// 	Many cloud providers block outbound connections on port 25, in which case we can hand our
+	// 	emails to a smart host instead. Relays can also be configured for specific recipient domains.
+	// e.OutgoingRelay = &email.Relay{
+	// 	Host:     "smtp.example.net",
+	// 	Port:     587,
+	// 	Security: email.RelaySTARTTLS,
+	// 	Username: "apikey",
+	// 	Password: os.Getenv("RELAY_PASSWORD"),
+	// }
+
+	// Transport Maps
+	// 	Recipients can be routed by their domain, for example emails to our own domain can be
+	// 	delivered straight to our inboxes. The rules can be swapped out later by calling Reload.
+	transport, err := email.NewTransportMap(
+		email.TransportRule{Domain: SMTP_DOMAIN, Action: email.TransportLocal},
+		email.TransportRule{Domain: "*.invalid", Action: email.TransportDiscard},
+	)
+	if err != nil {
+		log.Fatalln("Cannot Create Transport Map:", err)
+	}
+	e.OutgoingTransport = transport
+
+	// Connection Reuse
+	// 	Connections to mail exchangers are kept open for a short while so later emails can reuse them.
+	// 	Each email is still sent in its own transaction, emails are never combined to save on RCPTs.
+	e.OutgoingPoolSize = 4
+	e.OutgoingPoolTimeout = time.Minute
+
+	// Rate Limiting
+	// 	Large providers throttle senders that hit them too hard, we can limit how quickly emails are sent
+	// 	to each domain. Throttled emails are retried later and adaptive limits back off when told to.
+	e.OutgoingRateLimit = email.RateLimit{Connections: 4, Adaptive: true}
+	e.OutgoingRateLimits = map[string]email.RateLimit{
+		"gmail.com": {MessagesPerMinute: 60, Connections: 2, Adaptive: true},
+	}
+
+	// DKIM
+	// 	Besides the key given to StartSMTP, emails can be signed with additional keys. Signing with both
+	// 	an RSA and an Ed25519 key keeps older receivers happy while newer ones can verify the smaller key.
+	// edSigner, err := email.LoadDKIMSigner("dkim_ed25519.pem")
+	// if err != nil {
+	// 	log.Fatalln("Cannot Load DKIM Key: ", err)
+	// }
+	// e.OutgoingDKIMSigners = []email.DKIMSigner{{Selector: "ed25519", Key: edSigner}}
+	e.OutgoingDKIMCanonical = "relaxed/relaxed"
+	e.OutgoingDKIMHeaders = []string{"From", "To", "Cc", "Reply-To", "Subject", "Date", "Message-ID", "In-Reply-To", "References", "MIME-Version", "Content-Type"}
+
+	// Rotating DKIM Keys
+	// 	Keys held by a keyring are switched over on schedule without a restart. Add the next key well
+	// 	ahead of time and publish the records returned by DKIMRecords before it becomes active.
+	// keyring, err := email.NewDKIMKeyring(email.DKIMKey{
+	// 	DKIMSigner: email.DKIMSigner{Selector: "2027", Key: nextSigner},
+	// 	ActiveFrom: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+	// })
+	// if err != nil {
+	// 	log.Fatalln("Cannot Create DKIM Keyring:", err)
+	// }
+	// e.OutgoingDKIMKeyring = keyring
+	// records, _ := e.DKIMRecords()
+	// for _, r := range records {
+	// 	log.Printf("Publish TXT %s %q\n", r.Name, r.Value)
+	// }
+
+	// Hosting Multiple Domains
+	// 	Additional domains can be hosted with their own DKIM keys, emails are signed according to their
+	// 	sender and inboxes can be registered by their full address. Emails from unknown domains are rejected.
+	// brandSigner, err := email.LoadDKIMSigner("dkim_brand.pem")
+	// if err != nil {
+	// 	log.Fatalln("Cannot Load DKIM Key: ", err)
+	// }
+	// e.RegisterDomain("brand.example", email.DKIMSigner{Selector: "default", Key: brandSigner})
+	// e.RegisterInbox("support@brand.example", func(em *email.Email) error { return nil })
+
+	// Templates
+	// 	Instead of rendering emails themselves, clients can POST to /send-template with the name of a
+	// 	template and some variables for each recipient. See TemplateRegistry for the directory layout.
+	if _, err := os.Stat(PATH_TMPL); err == nil {
+		templates, err := email.LoadTemplatesDir(PATH_TMPL)
+		if err != nil {
+			log.Fatalln("Cannot Load Templates:", err)
+		}
+		e.Templates = templates
+	}
+
 	// Startup Servers
 	// 	We use the provided Load functions to quickly parse and initialize a TLS Configuration and DKIM Signer.
 	// 	For this example TLS on the REST API is disabled by passing nil, but you should enable this in production.
@@ -128,6 +256,21 @@ func main() {
 	go e.StartSMTP(SMTP_ADDRESS, dkimSigner, tlsConfig)
 	go e.StartHTTP(HTTP_ADDRESS, nil)
 
+	// Example: Submission Server
+	// 	Mail clients and internal apps can send through the engine over SMTP instead of the REST API, users
+	// 	authenticate over STARTTLS (587) or implicit TLS (465) and may only send as their permitted addresses.
+	// 	Password hashes can be generated with email.HashPassword, bcrypt hashes are also accepted.
+	// users, err := email.NewMemoryCredentialStore(email.SubmissionUser{
+	// 	Username:     "newsletter",
+	// 	PasswordHash: "$argon2id$v=19$m=65536,t=3,p=4$...",
+	// 	Addresses:    []string{"news@" + SMTP_DOMAIN},
+	// })
+	// if err != nil {
+	// 	log.Fatalln("Cannot Load Submission Users:", err)
+	// }
+	// e.SubmissionUsers = users
+	// go e.StartSubmission(":587", tlsConfig, false)
+
 	// Shutdown Server
 	// 	We await a SIGINT/SIGTERM signal from the OS, the Shutdown function will return once all connections
 	// 	have closed and all our emails have been sent out.